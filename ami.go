@@ -2,26 +2,16 @@ package ami
 
 import (
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/go-redis/redis/v7"
 )
 
 func newClient(opt clientOptions) (*client, error) {
-	// Fix for users, that forget set timeouts
-	if opt.ropt.ReadTimeout < time.Second*30 {
-		opt.ropt.ReadTimeout = time.Second * 30
-	}
-
-	if opt.ropt.WriteTimeout < time.Second*30 {
-		opt.ropt.WriteTimeout = time.Second * 30
-	}
-
-	rDB := redis.NewClusterClient(opt.ropt)
-
 	c := &client{
 		opt: opt,
-		rDB: rDB,
+		rDB: newRedis(opt),
 	}
 
 	err := c.init()
@@ -32,38 +22,56 @@ func newClient(opt clientOptions) (*client, error) {
 	return c, nil
 }
 
-func (c *client) init() error {
-	group := fmt.Sprintf("qu_%s_group", c.opt.name)
+func newRedis(opt clientOptions) redis.UniversalClient {
+	// Externally supplied client is used as is
+	if opt.rDB != nil {
+		return opt.rDB
+	}
 
+	// Fix for users, that forget set timeouts
+	if opt.ropt.ReadTimeout < time.Second*30 {
+		opt.ropt.ReadTimeout = time.Second * 30
+	}
+
+	if opt.ropt.WriteTimeout < time.Second*30 {
+		opt.ropt.WriteTimeout = time.Second * 30
+	}
+
+	return redis.NewClusterClient(opt.ropt)
+}
+
+func (c *client) init() error {
 	for i := 0; i < int(c.opt.shardsCount); i++ {
 		stream := fmt.Sprintf("qu{%d}_%s", i, c.opt.name)
 
-		err := c.createShard(stream, group)
-		if err != nil {
-			return err
+		for _, group := range c.opt.groups {
+			err := c.createShard(stream, group)
+			if err != nil {
+				return err
+			}
 		}
 	}
 
 	return nil
 }
 
+// createShard creates stream and consumer group in it, if they don't exist.
 func (c *client) createShard(stream string, group string) error {
-	xinfo := redis.NewCmd("XINFO", "STREAM", stream)
-
-	err := c.rDB.Process(xinfo)
-	// It is not an error, we only check stream existence
-	if err != nil {
-		xgroup := redis.NewCmd("XGROUP", "CREATE", stream, group, "$", "MKSTREAM")
-
-		err := c.rDB.Process(xgroup)
-		if err != nil {
-			return err
+	// Error means, that stream doesn't exist, so it is created with group
+	groups, err := c.xinfo("GROUPS", stream)
+	if err == nil {
+		for _, g := range groups {
+			if infoString(g, "name") == group {
+				return nil
+			}
 		}
 	}
 
-	// Check after creation
-	err = c.rDB.Process(xinfo)
-	if err != nil {
+	xgroup := redis.NewCmd("XGROUP", "CREATE", stream, group, c.opt.startID, "MKSTREAM")
+
+	err = c.rDB.Process(xgroup)
+	// Group may be created by other client at same time
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
 		return err
 	}
 
@@ -0,0 +1,447 @@
+// Command ami inspects and operates Ami queues.
+//
+// Usage:
+//
+//	ami [flags] <command> <queue> [args] [command flags]
+//
+// Commands:
+//
+//	stats <queue>                     lengths, pending messages and consumers
+//	peek <queue> [-n 10]              oldest messages of every shard
+//	tail <queue>                      follow new messages
+//	purge <queue> -yes                delete all messages
+//	requeue-pending <queue> [-consumer name] [-idle 0s] [-group name]
+//	                [-ack-mode delete]
+//	                                  return pending messages to queue
+//	delete-consumer <queue> <consumer> [-group name]
+//	                                  delete consumer from group
+//	create-group <queue> <group> [-from 0]
+//	                                  create group to replay messages from ID
+//	                                  or RFC 3339 time
+//	delete-group <queue> <group>      delete group
+//	send <queue> <message>            send message and print its ID
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/kak-tus/ami"
+)
+
+type command struct {
+	run   func(rDB redis.UniversalClient, shards int8, args []string) error
+	usage string
+}
+
+var commands = map[string]command{
+	"create-group":    {createGroup, "<queue> <group> [-from 0]"},
+	"delete-consumer": {deleteConsumer, "<queue> <consumer> [-group name]"},
+	"delete-group":    {deleteGroup, "<queue> <group>"},
+	"peek":            {peek, "<queue> [-n 10]"},
+	"purge":           {purge, "<queue> -yes"},
+	"requeue-pending": {requeuePending, "<queue> [-consumer name] [-idle 0s] [-group name] [-ack-mode delete]"},
+	"send":            {send, "<queue> <message>"},
+	"stats":           {stats, "<queue>"},
+	"tail":            {tail, "<queue>"},
+}
+
+func main() {
+	addrs := flag.String("addrs", "127.0.0.1:6379", "comma separated Redis addresses")
+	standalone := flag.Bool("standalone", false, "use standalone Redis instead of Redis Cluster")
+	shards := flag.Int("shards", 10, "shards count of queue")
+
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command %s\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+
+	var rDB redis.UniversalClient
+
+	if *standalone {
+		rDB = redis.NewClient(&redis.Options{
+			Addr:         strings.Split(*addrs, ",")[0],
+			ReadTimeout:  time.Second * 60,
+			WriteTimeout: time.Second * 60,
+		})
+	} else {
+		rDB = redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:        strings.Split(*addrs, ","),
+			ReadTimeout:  time.Second * 60,
+			WriteTimeout: time.Second * 60,
+		})
+	}
+
+	defer rDB.Close()
+
+	err := cmd.run(rDB, int8(*shards), flag.Args()[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", flag.Arg(0), err.Error())
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [flags] <command> <queue> [args] [command flags]\n\nCommands:\n", os.Args[0])
+
+	for _, name := range []string{"stats", "peek", "tail", "purge", "requeue-pending", "delete-consumer", "create-group", "delete-group", "send"} {
+		fmt.Fprintf(os.Stderr, "  %s %s\n", name, commands[name].usage)
+	}
+
+	fmt.Fprintf(os.Stderr, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+func newInspector(rDB redis.UniversalClient, shards int8, queue string) (*ami.Inspector, error) {
+	return newGroupInspector(rDB, shards, queue, "")
+}
+
+// newGroupInspector creates inspector of group, default group if group is
+// empty.
+func newGroupInspector(rDB redis.UniversalClient, shards int8, queue string, group string) (*ami.Inspector, error) {
+	return ami.NewInspectorWithClient(ami.InspectorOptions{Group: group, Name: queue, ShardsCount: shards}, rDB)
+}
+
+// Names of ACK modes for -ack-mode flag
+var ackModes = map[string]ami.AckMode{
+	"delete":       ami.AckAndDelete,
+	"delete-acked": ami.AckAndDeleteAcked,
+	"only":         ami.AckOnly,
+}
+
+// parseArgs parses command flags and arguments. Flags are allowed both before
+// and after arguments, so "peek -n 10 queue" and "peek queue -n 10" are same.
+func parseArgs(fs *flag.FlagSet, args []string, names ...string) ([]string, error) {
+	var pos []string
+
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+
+		if fs.NArg() == 0 {
+			break
+		}
+
+		pos = append(pos, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+
+	if len(pos) != len(names) {
+		return nil, fmt.Errorf("expected arguments: %s", strings.Join(names, " "))
+	}
+
+	return pos, nil
+}
+
+func stats(rDB redis.UniversalClient, shards int8, args []string) error {
+	args, err := parseArgs(flag.NewFlagSet("stats", flag.ExitOnError), args, "<queue>")
+	if err != nil {
+		return err
+	}
+
+	insp, err := newInspector(rDB, shards, args[0])
+	if err != nil {
+		return err
+	}
+
+	st, err := insp.Stats()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Queue %s: length %d, pending %d, lag %s\n\n", st.Name, st.Length, st.Pending, lag(st.Lag))
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(w, "STREAM\tLENGTH\tGROUP\tPENDING\tLAST DELIVERED\tLAG\tCONSUMER\tCONSUMER PENDING\tIDLE")
+
+	for _, s := range st.Shards {
+		if len(s.Groups) == 0 {
+			fmt.Fprintf(w, "%s\t%d\t-\t-\t-\t-\t-\t-\t-\n", s.Stream, s.Length)
+			continue
+		}
+
+		for _, g := range s.Groups {
+			if len(g.Consumers) == 0 {
+				fmt.Fprintf(w, "%s\t%d\t%s\t%d\t%s\t%s\t-\t-\t-\n",
+					s.Stream, s.Length, g.Name, g.Pending, g.LastDeliveredID, lag(g.Lag))
+				continue
+			}
+
+			for _, c := range g.Consumers {
+				fmt.Fprintf(w, "%s\t%d\t%s\t%d\t%s\t%s\t%s\t%d\t%s\n",
+					s.Stream, s.Length, g.Name, g.Pending, g.LastDeliveredID, lag(g.Lag),
+					c.Name, c.Pending, c.Idle)
+			}
+		}
+	}
+
+	return w.Flush()
+}
+
+func lag(l int64) string {
+	if l == -1 {
+		return "unknown"
+	}
+
+	return fmt.Sprint(l)
+}
+
+func peek(rDB redis.UniversalClient, shards int8, args []string) error {
+	fs := flag.NewFlagSet("peek", flag.ExitOnError)
+	n := fs.Int64("n", 10, "messages count from every shard")
+
+	args, err := parseArgs(fs, args, "<queue>")
+	if err != nil {
+		return err
+	}
+
+	insp, err := newInspector(rDB, shards, args[0])
+	if err != nil {
+		return err
+	}
+
+	lst, err := insp.Peek(*n)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range lst {
+		printMessage(m)
+	}
+
+	return nil
+}
+
+func tail(rDB redis.UniversalClient, shards int8, args []string) error {
+	args, err := parseArgs(flag.NewFlagSet("tail", flag.ExitOnError), args, "<queue>")
+	if err != nil {
+		return err
+	}
+
+	insp, err := newInspector(rDB, shards, args[0])
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		<-sig
+		cancel()
+	}()
+
+	return insp.Tail(ctx, printMessage)
+}
+
+func printMessage(m ami.Message) {
+	fmt.Printf("%s\t%s\t%q", m.Stream, m.ID, m.Body)
+
+	for k, v := range m.Headers {
+		fmt.Printf("\t%s=%q", k, v)
+	}
+
+	fmt.Println()
+}
+
+func purge(rDB redis.UniversalClient, shards int8, args []string) error {
+	fs := flag.NewFlagSet("purge", flag.ExitOnError)
+	yes := fs.Bool("yes", false, "confirm deleting of all messages")
+
+	args, err := parseArgs(fs, args, "<queue>")
+	if err != nil {
+		return err
+	}
+
+	if !*yes {
+		return errors.New("all messages of queue will be deleted, add -yes to confirm")
+	}
+
+	insp, err := newInspector(rDB, shards, args[0])
+	if err != nil {
+		return err
+	}
+
+	cnt, err := insp.Purge()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Deleted %d messages\n", cnt)
+
+	return nil
+}
+
+func requeuePending(rDB redis.UniversalClient, shards int8, args []string) error {
+	fs := flag.NewFlagSet("requeue-pending", flag.ExitOnError)
+	consumer := fs.String("consumer", "", "requeue only messages of consumer")
+	idle := fs.Duration("idle", 0, "requeue only messages, that idle at least this time")
+	group := fs.String("group", "", "consumer group, default group of queue if empty")
+	ackMode := fs.String("ack-mode", "delete", "ACK mode of consumers of group: delete, delete-acked or only")
+
+	args, err := parseArgs(fs, args, "<queue>")
+	if err != nil {
+		return err
+	}
+
+	mode, ok := ackModes[*ackMode]
+	if !ok {
+		return fmt.Errorf("unknown ACK mode %s", *ackMode)
+	}
+
+	insp, err := ami.NewInspectorWithClient(ami.InspectorOptions{
+		AckMode:     mode,
+		Group:       *group,
+		Name:        args[0],
+		ShardsCount: shards,
+	}, rDB)
+	if err != nil {
+		return err
+	}
+
+	cnt, err := insp.RequeuePending(*consumer, *idle)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Requeued %d messages\n", cnt)
+
+	return nil
+}
+
+func deleteConsumer(rDB redis.UniversalClient, shards int8, args []string) error {
+	fs := flag.NewFlagSet("delete-consumer", flag.ExitOnError)
+	group := fs.String("group", "", "consumer group, default group of queue if empty")
+
+	args, err := parseArgs(fs, args, "<queue>", "<consumer>")
+	if err != nil {
+		return err
+	}
+
+	insp, err := newGroupInspector(rDB, shards, args[0], *group)
+	if err != nil {
+		return err
+	}
+
+	cnt, err := insp.DeleteConsumer(args[1])
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Deleted consumer with %d pending messages\n", cnt)
+
+	return nil
+}
+
+func createGroup(rDB redis.UniversalClient, shards int8, args []string) error {
+	fs := flag.NewFlagSet("create-group", flag.ExitOnError)
+	from := fs.String("from", "0", "stream ID or RFC 3339 time, from which messages are replayed")
+
+	args, err := parseArgs(fs, args, "<queue>", "<group>")
+	if err != nil {
+		return err
+	}
+
+	insp, err := newInspector(rDB, shards, args[0])
+	if err != nil {
+		return err
+	}
+
+	start := *from
+
+	if t, err := time.Parse(time.RFC3339, start); err == nil {
+		start = ami.TimeID(t)
+	}
+
+	if err := insp.CreateGroup(args[1], start); err != nil {
+		return err
+	}
+
+	fmt.Printf("Created group %s at %s\n", args[1], start)
+
+	return nil
+}
+
+func deleteGroup(rDB redis.UniversalClient, shards int8, args []string) error {
+	args, err := parseArgs(flag.NewFlagSet("delete-group", flag.ExitOnError), args, "<queue>", "<group>")
+	if err != nil {
+		return err
+	}
+
+	insp, err := newInspector(rDB, shards, args[0])
+	if err != nil {
+		return err
+	}
+
+	if err := insp.DeleteGroup(args[1]); err != nil {
+		return err
+	}
+
+	fmt.Printf("Deleted group %s\n", args[1])
+
+	return nil
+}
+
+func send(rDB redis.UniversalClient, shards int8, args []string) error {
+	args, err := parseArgs(flag.NewFlagSet("send", flag.ExitOnError), args, "<queue>", "<message>")
+	if err != nil {
+		return err
+	}
+
+	pr, err := ami.NewProducerWithClient(ami.ProducerOptions{
+		ErrorNotifier:     &errorLogger{},
+		Name:              args[0],
+		PendingBufferSize: 1,
+		PipeBufferSize:    1,
+		ShardsCount:       shards,
+	}, rDB)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	id, err := pr.SendSync(ctx, args[1])
+	if err != nil {
+		return err
+	}
+
+	if err := pr.CloseContext(ctx); err != nil {
+		return err
+	}
+
+	fmt.Println(id)
+
+	return nil
+}
+
+type errorLogger struct{}
+
+func (l *errorLogger) AmiError(err error) {
+	fmt.Fprintln(os.Stderr, "Got error from Ami:", err.Error())
+}
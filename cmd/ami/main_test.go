@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseArgs(t *testing.T) {
+	for _, args := range [][]string{
+		{"ruthie", "-n", "5"},
+		{"-n", "5", "ruthie"},
+		{"-n=5", "ruthie"},
+	} {
+		fs := flag.NewFlagSet("peek", flag.ContinueOnError)
+		n := fs.Int64("n", 10, "")
+
+		pos, err := parseArgs(fs, args, "<queue>")
+		assert.NoError(t, err, "must not be an error")
+		assert.Equal(t, []string{"ruthie"}, pos)
+		assert.Equal(t, int64(5), *n)
+	}
+
+	fs := flag.NewFlagSet("delete-group", flag.ContinueOnError)
+
+	pos, err := parseArgs(fs, []string{"ruthie", "replay"}, "<queue>", "<group>")
+	assert.NoError(t, err, "must not be an error")
+	assert.Equal(t, []string{"ruthie", "replay"}, pos)
+}
+
+func TestParseArgsErrors(t *testing.T) {
+	fs := flag.NewFlagSet("delete-group", flag.ContinueOnError)
+
+	_, err := parseArgs(fs, []string{"ruthie"}, "<queue>", "<group>")
+	assert.EqualError(t, err, "expected arguments: <queue> <group>")
+
+	_, err = parseArgs(fs, []string{"ruthie", "replay", "other"}, "<queue>", "<group>")
+	assert.Error(t, err, "must be an error")
+
+	fs = flag.NewFlagSet("purge", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	fs.Bool("yes", false, "")
+
+	_, err = parseArgs(fs, []string{"ruthie", "-unknown"}, "<queue>")
+	assert.Error(t, err, "must be an error")
+}
+
+func TestPurgeConfirmation(t *testing.T) {
+	err := purge(nil, 1, []string{"ruthie"})
+	assert.EqualError(t, err, "all messages of queue will be deleted, add -yes to confirm")
+}
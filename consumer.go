@@ -1,14 +1,16 @@
 package ami
 
 import (
-	"errors"
+	"context"
 	"fmt"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-redis/redis/v7"
 	"github.com/imdario/mergo"
-	"github.com/ssgreg/repeat"
 )
 
 // NewConsumer creates new consumer client for Ami
@@ -23,30 +25,69 @@ import (
 // big messages. And not so strictly for Consumer, because it send big queries
 // with not so big messages (only ids of ACKed messages).
 func NewConsumer(opt ConsumerOptions, ropt *redis.ClusterOptions) (*Consumer, error) {
+	return newConsumer(opt, clientOptions{ropt: ropt})
+}
+
+// NewConsumerWithClient creates new consumer client for Ami with externally
+// supplied Redis client.
+//
+// Any redis.UniversalClient can be used: redis.Client for standalone Redis,
+// failover redis.Client for Redis Sentinel or redis.ClusterClient for Redis
+// Cluster. Shards of queue are placed by hash tags, so same queue can be used
+// with any of them.
+// Client is used as is, so ReadTimeout and WriteTimeout notes of NewConsumer
+// are applicable to it too. Client is not closed by Ami.
+func NewConsumerWithClient(opt ConsumerOptions, rDB redis.UniversalClient) (*Consumer, error) {
+	return newConsumer(opt, clientOptions{rDB: rDB})
+}
+
+func newConsumer(opt ConsumerOptions, copt clientOptions) (*Consumer, error) {
 	if err := mergo.Merge(&opt, defaultConsumerOptions); err != nil {
 		return nil, err
 	}
 
-	client, err := newClient(clientOptions{
-		name:        opt.Name,
-		ropt:        ropt,
-		shardsCount: opt.ShardsCount,
-	})
+	if opt.Group == "" {
+		opt.Group = defaultGroup(opt.Name)
+	}
+
+	copt.groups = []string{opt.Group}
+	copt.name = opt.Name
+	copt.startID = opt.GroupStartID
+	copt.shardsCount = opt.ShardsCount
+
+	client, err := newClient(copt)
 	if err != nil {
 		return nil, err
 	}
 
 	cCons := make(chan Message, opt.PrefetchCount)
-	cAck := make(chan Message, opt.PendingBufferSize)
+	cAck := make(chan toAck, opt.PendingBufferSize)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ctxAck, cancelAck := context.WithCancel(context.Background())
 
 	cn := &Consumer{
-		cAck:   cAck,
-		cCons:  cCons,
-		cl:     client,
-		notif:  opt.ErrorNotifier,
-		opt:    opt,
-		wgAck:  &sync.WaitGroup{},
-		wgCons: &sync.WaitGroup{},
+		cAck:      cAck,
+		cCons:     cCons,
+		cancel:    cancel,
+		cancelAck: cancelAck,
+		cl:        client,
+		ctx:       ctx,
+		ctxAck:    ctxAck,
+		metr:      opt.MetricsNotifier,
+		notif:     opt.ErrorNotifier,
+		opt:       opt,
+		wgAck:     &sync.WaitGroup{},
+		wgCons:    &sync.WaitGroup{},
+	}
+
+	if opt.MaxInFlightPipelines > 0 {
+		cn.inFlight = make(chan struct{}, opt.MaxInFlightPipelines)
+	}
+
+	cn.wakeDelayed = make([]chan struct{}, opt.ShardsCount)
+	for i := range cn.wakeDelayed {
+		cn.wakeDelayed[i] = make(chan struct{}, 1)
 	}
 
 	cn.wgAck.Add(1)
@@ -60,37 +101,178 @@ func NewConsumer(opt ConsumerOptions, ropt *redis.ClusterOptions) (*Consumer, er
 //
 // Start read messages from Redis streams and return channel.
 func (c *Consumer) Start() chan Message {
+	return c.StartContext(context.Background())
+}
+
+// StartContext consume from queue until context is done or Stop is called.
+//
+// Start read messages from Redis streams and return channel.
+// Channel is closed after context is done and all read messages are pushed to
+// channel or dropped, if nobody reads channel. Dropped messages stay pending
+// and will be got again from backlog.
+func (c *Consumer) StartContext(ctx context.Context) chan Message {
+	c.ctx, c.cancel = context.WithCancel(ctx)
+	c.cStopped = make(chan struct{})
+
 	for i := 0; i < int(c.opt.ShardsCount); i++ {
 		c.wgCons.Add(1)
 
 		go c.consume(i)
+
+		c.wgCons.Add(1)
+
+		go c.delayed(i)
+
+		if c.opt.MinIdleTime > 0 {
+			c.wgCons.Add(1)
+
+			go c.reclaim(i)
+		}
 	}
 
+	go func() {
+		c.wgCons.Wait()
+		close(c.cCons)
+		close(c.cStopped)
+	}()
+
 	return c.cCons
 }
 
 // Stop queue client.
 //
-// Stop reading messages from Redis streams and lock until all
-// read messages being processed.
+// Stop reading messages from Redis streams and lock until consumer channel is
+// closed. Messages, that are read from Redis, but are not pushed to channel
+// yet, are dropped and stay pending, so they will be got again from backlog.
+// Messages, that are already in channel, are still available to read from it.
 func (c *Consumer) Stop() {
-	c.needStop = true
+	c.cancel()
+
+	// Not started consumer
+	if c.cStopped == nil {
+		close(c.cCons)
+		return
+	}
+
+	<-c.cStopped
+}
+
+// Handler processes message, got from queue, in Run.
+//
+// If handler returns nil - message is ACKed. Otherwise message stays pending
+// and is redelivered by reclaiming after MinIdleTime, if it is set, or after
+// restart of consumer. If MaxDeliveries is set, error is stored in Redis to
+// write it to dead-letter stream, when message will exceed MaxDeliveries. Use
+// Nack or NackWithError in handler to return message to queue immediately,
+// returned value is ignored then.
+type Handler func(ctx context.Context, m Message) error
+
+// Run consume from queue and process messages with handler in pool of
+// concurrency workers.
+//
+// Run locks until context is done and all processing messages are processed.
+// Messages, that are got, but are not passed to handler before context is
+// done, stay pending.
+// Panics in handler are recovered and sent to ErrorNotifier, message stays
+// pending as for error.
+// After Run Close() must be called to send all ACKs to Redis.
+func (c *Consumer) Run(ctx context.Context, handler Handler, concurrency int) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	ch := c.StartContext(ctx)
+
+	wg := sync.WaitGroup{}
+	wg.Add(concurrency)
+
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			for m := range ch {
+				if ctx.Err() != nil {
+					if c.opt.Tracer != nil {
+						c.opt.Tracer.AmiNack(m, ctx.Err())
+					}
+
+					continue
+				}
+
+				m.settled = new(int32)
+
+				err := c.handle(ctx, handler, m)
+
+				// Handler did Ack or Nack itself
+				if atomic.LoadInt32(m.settled) == 1 {
+					continue
+				}
+
+				if err == nil {
+					c.Ack(m)
+				} else {
+					c.setLastError(m, err)
+
+					if c.opt.Tracer != nil {
+						c.opt.Tracer.AmiNack(m, err)
+					}
+				}
+			}
 
-	c.wgCons.Wait()
-	close(c.cCons)
-	c.stopped = true
+			wg.Done()
+		}()
+	}
+
+	wg.Wait()
+}
+
+func (c *Consumer) handle(ctx context.Context, handler Handler, m Message) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Panic in handler of message with id %s: %v", m.ID, r)
+
+			if c.notif != nil {
+				c.notif.AmiError(err)
+			}
+		}
+	}()
+
+	return handler(ctx, m)
 }
 
 // Close queue client
 //
 // Lock until all ACK messages will be sent to Redis.
 func (c *Consumer) Close() {
+	_ = c.CloseContext(context.Background())
+}
+
+// CloseContext closes queue client
+//
+// Lock until all ACK messages will be sent to Redis or context is done.
+// If context is done before - sending of ACK messages is cancelled and
+// context error is returned. Not sent ACKs are lost and messages will be
+// processed again.
+func (c *Consumer) CloseContext(ctx context.Context) error {
 	close(c.cAck)
-	c.wgAck.Wait()
+
+	done := make(chan struct{})
+
+	go func() {
+		c.wgAck.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		c.cancelAck()
+		return nil
+	case <-ctx.Done():
+		c.cancelAck()
+		return ctx.Err()
+	}
 }
 
 func (c *Consumer) consume(shard int) {
-	group := fmt.Sprintf("qu_%s_group", c.opt.Name)
+	group := c.opt.Group
 	stream := fmt.Sprintf("qu{%d}_%s", shard, c.opt.Name)
 
 	lastID := "0-0"
@@ -103,7 +285,7 @@ func (c *Consumer) consume(shard int) {
 	}
 
 	for {
-		if c.needStop {
+		if c.ctx.Err() != nil {
 			break
 		}
 
@@ -116,90 +298,437 @@ func (c *Consumer) consume(shard int) {
 
 		var res []redis.XStream
 
-		err := repeat.Repeat(
-			repeat.Fn(func() error {
-				var err error
-
-				res, err = c.cl.rDB.XReadGroup(&redis.XReadGroupArgs{
-					Block:    block,
-					Consumer: c.opt.Consumer,
-					Count:    c.opt.PrefetchCount,
-					Group:    group,
-					Streams:  []string{stream, id},
-				}).Result()
-
-				if err != nil && err != redis.Nil {
-					if c.notif != nil {
-						c.notif.AmiError(err)
+		err := c.opt.RetryPolicy.retry(c.ctx, func() error {
+			var err error
+
+			res, err = c.cl.rDB.XReadGroup(&redis.XReadGroupArgs{
+				Block:    block,
+				Consumer: c.opt.Consumer,
+				Count:    c.opt.PrefetchCount,
+				Group:    group,
+				Streams:  []string{stream, id},
+			}).Result()
+
+			if err != nil && err != redis.Nil {
+				// Group is deleted after start of consumer
+				if strings.HasPrefix(err.Error(), "NOGROUP") {
+					if err := c.cl.createShard(stream, group); err != nil {
+						return err
 					}
-
-					return repeat.HintTemporary(err)
 				}
 
-				return nil
-			}),
-			repeat.StopOnSuccess(),
-			repeat.WithDelay(repeat.FullJitterBackoff(500*time.Millisecond).Set()),
-		)
+				return err
+			}
 
-		if err != nil {
+			return nil
+		}, func(err error) {
 			if c.notif != nil {
 				c.notif.AmiError(err)
 			}
 
+			if c.metr != nil {
+				c.metr.AmiRetry(c.opt.Name, shard, "read", err)
+			}
+		})
+
+		if err != nil {
+			if c.notif != nil && c.ctx.Err() == nil {
+				c.notif.AmiError(err)
+			}
+
+			// Don't start reading again immediately, if retries are exhausted
+			select {
+			case <-c.ctx.Done():
+			case <-time.After(c.opt.RetryPolicy.BaseDelay):
+			}
+
 			continue
 		}
 
+		if c.metr != nil {
+			c.metr.AmiBuffer(c.opt.Name, "consume", len(c.cCons), cap(c.cCons))
+		}
+
 		if checkBacklog && (len(res) == 0 || len(res[0].Messages) == 0) {
 			checkBacklog = false
 			continue
 		}
 
 		for _, s := range res {
+			var counts map[string]int64
+
+			// Only messages from backlog can be delivered more then once
+			if checkBacklog && c.opt.MaxDeliveries > 0 && len(s.Messages) != 0 {
+				counts, err = c.deliveries(stream, group, s.Messages)
+				if err != nil && c.notif != nil {
+					c.notif.AmiError(err)
+				}
+			}
+
 			for _, m := range s.Messages {
 				lastID = m.ID
 
-				msg := Message{
-					Group:  group,
-					ID:     m.ID,
-					Stream: stream,
+				if counts[m.ID] > c.opt.MaxDeliveries {
+					err := c.deadLetter(stream, group, m, counts[m.ID], maxDeliveriesReason(counts[m.ID], c.opt.MaxDeliveries))
+					if err != nil && c.notif != nil {
+						c.notif.AmiError(err)
+					}
+
+					continue
 				}
 
-				v, ok := m.Values["m"]
-				if !ok {
-					if c.notif != nil {
-						c.notif.AmiError(errors.New("Incorrect message format: no \"m\" field in message with id " + m.ID))
-					}
+				c.deliver(shard, stream, group, m)
+			}
+		}
+	}
 
-					c.Ack(msg)
+	c.wgCons.Done()
+}
+
+func (c *Consumer) deliver(shard int, stream string, group string, m redis.XMessage) {
+	msg, err := parseMessage(stream, group, m)
+	if err != nil {
+		if c.notif != nil {
+			c.notif.AmiError(err)
+		}
+
+		c.Ack(msg)
+
+		return
+	}
+
+	// Message, returned to queue by Nack of other group
+	if g, ok := m.Values[groupField]; ok && g != group {
+		c.cAck <- toAck{group: group, id: msg.ID, stream: stream}
+		return
+	}
+
+	if c.opt.Tracer != nil {
+		msg.ctx = c.opt.Tracer.AmiReceive(msg)
+	}
+
+	select {
+	case c.cCons <- msg:
+		if c.metr != nil {
+			c.metr.AmiConsumed(c.opt.Name, shard, 1)
+		}
+	case <-c.ctx.Done():
+		if c.opt.Tracer != nil {
+			c.opt.Tracer.AmiNack(msg, c.ctx.Err())
+		}
+	}
+}
+
+// delayed moves due delayed messages of shard to stream.
+//
+// Check is done every DelayPeriod, if there are due messages, and backs off up
+// to DelayIdlePeriod, if there are no messages or they are due later.
+func (c *Consumer) delayed(shard int) {
+	timer := time.NewTimer(c.opt.DelayPeriod)
+	defer timer.Stop()
+
+	for {
+		var doStop bool
+
+		select {
+		case <-c.ctx.Done():
+			doStop = true
+		case <-timer.C:
+		case <-c.wakeDelayed[shard]:
+			if !timer.Stop() {
+				<-timer.C
+			}
+		}
+
+		if doStop {
+			break
+		}
+
+		var (
+			moved int64
+			next  time.Time
+			err   error
+		)
+
+		// Continue moving, while there are full batches of due messages
+		for c.ctx.Err() == nil {
+			moved, next, err = c.cl.moveDelayed(shard, c.opt.PrefetchCount)
+			if err != nil && c.notif != nil {
+				c.notif.AmiError(err)
+			}
+
+			if err != nil || moved < c.opt.PrefetchCount {
+				break
+			}
+		}
+
+		wait := c.opt.DelayPeriod
+
+		if err == nil {
+			if next.IsZero() {
+				wait = c.opt.DelayIdlePeriod
+			} else if until := time.Until(next); until > wait {
+				wait = until
+			}
+
+			if wait > c.opt.DelayIdlePeriod {
+				wait = c.opt.DelayIdlePeriod
+			}
+
+			if wait < c.opt.DelayPeriod {
+				wait = c.opt.DelayPeriod
+			}
+		}
+
+		timer.Reset(wait)
+	}
+
+	c.wgCons.Done()
+}
+
+func (c *Consumer) reclaim(shard int) {
+	group := c.opt.Group
+	stream := fmt.Sprintf("qu{%d}_%s", shard, c.opt.Name)
+
+	tick := time.NewTicker(c.opt.ReclaimPeriod)
+	defer tick.Stop()
+
+	for {
+		var doStop bool
+
+		select {
+		case <-c.ctx.Done():
+			doStop = true
+		case <-tick.C:
+		}
+
+		if doStop {
+			break
+		}
+
+		c.reclaimShard(shard, stream, group)
+	}
+
+	c.wgCons.Done()
+}
+
+// reclaimShard walks through all pending messages of stream and claims
+// messages of other consumers, that idle longer then MinIdleTime.
+// XPENDING and XCLAIM are used instead of XAUTOCLAIM to support Redis 5.
+func (c *Consumer) reclaimShard(shard int, stream string, group string) {
+	start := "-"
+
+	for {
+		if c.ctx.Err() != nil {
+			return
+		}
+
+		pending, err := c.cl.rDB.XPendingExt(&redis.XPendingExtArgs{
+			Count:  c.opt.PrefetchCount,
+			End:    "+",
+			Group:  group,
+			Start:  start,
+			Stream: stream,
+		}).Result()
+
+		if err != nil && err != redis.Nil {
+			if c.notif != nil {
+				c.notif.AmiError(err)
+			}
+
+			return
+		}
+
+		ids := make([]string, 0, len(pending))
+		counts := make(map[string]int64, len(pending))
+
+		for _, p := range pending {
+			// Own messages are reclaimed too, because messages, that stay
+			// pending after error of handler, are not read again from backlog
+			if p.Idle < c.opt.MinIdleTime {
+				continue
+			}
+
+			ids = append(ids, p.ID)
+
+			// XCLAIM increments delivery count
+			counts[p.ID] = p.RetryCount + 1
+		}
+
+		if len(ids) != 0 {
+			res, err := c.cl.rDB.XClaim(&redis.XClaimArgs{
+				Consumer: c.opt.Consumer,
+				Group:    group,
+				Messages: ids,
+				MinIdle:  c.opt.MinIdleTime,
+				Stream:   stream,
+			}).Result()
+
+			if err != nil && err != redis.Nil {
+				if c.notif != nil {
+					c.notif.AmiError(err)
+				}
+
+				return
+			}
+
+			for _, m := range res {
+				if c.opt.MaxDeliveries > 0 && counts[m.ID] > c.opt.MaxDeliveries {
+					err := c.deadLetter(stream, group, m, counts[m.ID], maxDeliveriesReason(counts[m.ID], c.opt.MaxDeliveries))
+					if err != nil && c.notif != nil {
+						c.notif.AmiError(err)
+					}
 
 					continue
 				}
 
-				msg.Body = v.(string)
-				c.cCons <- msg
+				c.deliver(shard, stream, group, m)
 			}
 		}
+
+		if int64(len(pending)) < c.opt.PrefetchCount {
+			return
+		}
+
+		start = nextID(pending[len(pending)-1].ID)
 	}
+}
 
-	c.wgCons.Done()
+func maxDeliveriesReason(deliveries int64, max int64) string {
+	return fmt.Sprintf("Delivery count %d exceeds MaxDeliveries %d", deliveries, max)
+}
+
+// nextID returns minimal stream ID, that is greater then id.
+// Exclusive ranges are supported only since Redis 6.2, so calculate it.
+func nextID(id string) string {
+	parts := strings.SplitN(id, "-", 2)
+	if len(parts) != 2 {
+		return id
+	}
+
+	seq, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return id
+	}
+
+	return parts[0] + "-" + strconv.FormatUint(seq+1, 10)
 }
 
 // Ack acknowledges message
 //
 // Function not only do XACK call, but additionally it deletes message
-// from stream with XDELETE.
+// from stream with XDELETE, if AckMode is not AckOnly.
 // Ack do not do immediately, but pushed to send buffer and sended to Redis
 // in other goroutine.
 func (c *Consumer) Ack(m Message) {
-	c.cAck <- m
+	m.settle()
+
+	if c.opt.Tracer != nil {
+		c.opt.Tracer.AmiAck(m)
+	}
+
+	c.cAck <- toAck{group: m.Group, id: m.ID, stream: m.Stream}
+}
+
+// Nack negatively acknowledges message
+//
+// Message is returned to queue as new message with incremented Retries
+// counter and may be got by any consumer of queue. Original message is
+// ACKed and deleted from stream by AckMode.
+// If delay is greater then 0, message is returned to queue not earlier then
+// after delay.
+// If MaxDeliveries is set and message will exceed it - it is moved to
+// dead-letter stream.
+// Nack is done immediately in one transaction, unlike Ack.
+func (c *Consumer) Nack(m Message, delay time.Duration) error {
+	return c.NackWithError(m, delay, nil)
+}
+
+// NackWithError negatively acknowledges message with error of processing.
+//
+// Same as Nack, but error is stored in returned message and is written to
+// dead-letter stream, if message will exceed MaxDeliveries.
+func (c *Consumer) NackWithError(m Message, delay time.Duration, cause error) error {
+	m.settle()
+
+	err := c.nack(m, delay, cause)
+
+	if c.opt.Tracer != nil {
+		c.opt.Tracer.AmiNack(m, err)
+	}
+
+	return err
+}
+
+func (c *Consumer) nack(m Message, delay time.Duration, cause error) error {
+	values := setHeaders(map[string]interface{}{
+		"m": m.Body,
+		"r": m.Retries + 1,
+	}, m.Headers)
+
+	if cause != nil {
+		values[errorField] = cause.Error()
+	}
+
+	// Other groups already got this message
+	if c.opt.AckMode != AckAndDelete {
+		values[groupField] = m.Group
+	}
+
+	if c.opt.MaxDeliveries > 0 && int64(m.Retries)+1 >= c.opt.MaxDeliveries {
+		reason := fmt.Sprintf("Retries count %d exceeds MaxDeliveries %d", m.Retries+1, c.opt.MaxDeliveries)
+
+		return c.deadLetter(m.Stream, m.Group, redis.XMessage{ID: m.ID, Values: values}, int64(m.Retries)+1, reason)
+	}
+
+	pipe := c.cl.rDB.TxPipeline()
+
+	if delay > 0 {
+		pipe.ZAdd(m.Stream+"_delayed", &redis.Z{
+			Member: encodeDelayed(m.ID, values),
+			Score:  float64(time.Now().Add(delay).UnixNano() / int64(time.Millisecond)),
+		})
+	} else {
+		pipe.XAdd(&redis.XAddArgs{
+			ID:     "*",
+			Stream: m.Stream,
+			Values: values,
+		})
+	}
+
+	ackPipe(pipe, c.opt.AckMode, m.Stream, m.Group, m.ID)
+
+	_, err := pipe.Exec()
+
+	// Message may be due earlier then next check of delayed messages
+	if err == nil && delay > 0 {
+		shard := streamShard(m.Stream)
+
+		if shard < len(c.wakeDelayed) {
+			select {
+			case c.wakeDelayed[shard] <- struct{}{}:
+			default:
+			}
+		}
+	}
+
+	return err
 }
 
 func (c *Consumer) ack() {
 	started := time.Now()
 	tick := time.NewTicker(c.opt.PipePeriod)
 
-	toAck := make(map[string][]Message)
+	var metrTick <-chan time.Time
+
+	if c.metr != nil {
+		t := time.NewTicker(bufferMetricPeriod)
+		defer t.Stop()
+
+		metrTick = t.C
+	}
+
+	bufs := make(map[string][]toAck)
 	cnt := make(map[string]int)
 
 	for {
@@ -213,31 +742,33 @@ func (c *Consumer) ack() {
 			if !more {
 				doStop = true
 			} else {
-				stream = m.Stream
+				stream = m.stream
 
-				if toAck[stream] == nil {
-					toAck[stream] = make([]Message, c.opt.PipeBufferSize)
+				if bufs[stream] == nil {
+					bufs[stream] = make([]toAck, c.opt.PipeBufferSize)
 					cnt[stream] = 0
 				}
 
-				toAck[stream][cnt[stream]] = m
+				bufs[stream][cnt[stream]] = m
 				cnt[stream]++
 			}
 		case <-tick.C:
+		case <-metrTick:
+			c.metr.AmiBuffer(c.opt.Name, "ack", len(c.cAck), cap(c.cAck))
 		}
 
 		if doStop {
-			c.sendAckAllStreams(toAck, cnt)
+			c.sendAckAllStreams(bufs, cnt)
 			break
 		}
 
 		if cnt[stream] >= int(c.opt.PipeBufferSize) {
-			c.sendAckStreamWithLock(toAck[stream][0:cnt[stream]])
+			c.sendAckStreamWithLock(bufs[stream][0:cnt[stream]])
 			cnt[stream] = 0
 		} else if time.Since(started) >= c.opt.PipePeriod && len(c.cAck) == 0 {
 			// Don't send by time if there are more messages in channel
 			// Prefer to collect them in batch to speedup producing
-			c.sendAckAllStreams(toAck, cnt)
+			c.sendAckAllStreams(bufs, cnt)
 			started = time.Now()
 		}
 	}
@@ -245,56 +776,108 @@ func (c *Consumer) ack() {
 	c.wgAck.Done()
 }
 
-func (c *Consumer) sendAckAllStreams(toAck map[string][]Message, cnt map[string]int) {
-	for stream := range toAck {
-		c.sendAckStreamWithLock(toAck[stream][0:cnt[stream]])
+func (c *Consumer) sendAckAllStreams(bufs map[string][]toAck, cnt map[string]int) {
+	for stream := range bufs {
+		c.sendAckStreamWithLock(bufs[stream][0:cnt[stream]])
 		cnt[stream] = 0
 	}
 }
 
-func (c *Consumer) sendAckStreamWithLock(lst []Message) {
+func (c *Consumer) sendAckStreamWithLock(lst []toAck) {
 	if len(lst) == 0 {
 		return
 	}
 
 	ids := make([]string, len(lst))
 	for i, m := range lst {
-		ids[i] = m.ID
+		ids[i] = m.id
+	}
+
+	// Buffer is reused after return, so don't use it in goroutine
+	stream := lst[0].stream
+	group := lst[0].group
+
+	if c.inFlight != nil {
+		started := time.Now()
+
+		c.inFlight <- struct{}{}
+
+		if c.metr != nil {
+			c.metr.AmiInFlightWait(c.opt.Name, "ack", time.Since(started))
+		}
 	}
 
 	c.wgAck.Add(1)
 
+	if c.metr != nil {
+		c.metr.AmiInFlight(c.opt.Name, "ack", 1)
+	}
+
 	go func() {
-		c.sendAckStream(lst[0].Stream, lst[0].Group, ids)
+		c.sendAckStream(stream, group, ids)
+
+		if c.metr != nil {
+			c.metr.AmiInFlight(c.opt.Name, "ack", -1)
+		}
+
+		if c.inFlight != nil {
+			<-c.inFlight
+		}
+
 		c.wgAck.Done()
 	}()
 }
 
 func (c *Consumer) sendAckStream(stream string, group string, ids []string) {
-	err := repeat.Repeat(
-		repeat.Fn(func() error {
-			pipe := c.cl.rDB.TxPipeline()
+	shard := streamShard(stream)
+	started := time.Now()
 
-			pipe.XAck(stream, group, ids...)
-			pipe.XDel(stream, ids...)
+	err := c.opt.RetryPolicy.retry(c.ctxAck, func() error {
+		pipe := c.cl.rDB.TxPipeline()
 
-			_, err := pipe.Exec()
+		ackPipe(pipe, c.opt.AckMode, stream, group, ids...)
 
-			if err != nil {
-				if c.notif != nil {
-					c.notif.AmiError(err)
-				}
+		_, err := pipe.Exec()
 
-				return repeat.HintTemporary(err)
-			}
+		return err
+	}, func(err error) {
+		if c.notif != nil {
+			c.notif.AmiError(err)
+		}
 
-			return nil
-		}),
-		repeat.StopOnSuccess(),
-		repeat.WithDelay(repeat.FullJitterBackoff(500*time.Millisecond).Set()),
-	)
+		if c.metr != nil {
+			c.metr.AmiRetry(c.opt.Name, shard, "ack", err)
+		}
+	})
 
 	if err != nil && c.notif != nil {
 		c.notif.AmiError(err)
 	}
+
+	if err != nil && c.opt.FailNotifier != nil {
+		msgs := make([]Message, len(ids))
+		for i, id := range ids {
+			msgs[i] = Message{Group: group, ID: id, Stream: stream}
+		}
+
+		c.opt.FailNotifier.AmiFailed("ack", msgs, err)
+	}
+
+	if c.metr != nil {
+		c.metr.AmiPipeline(c.opt.Name, shard, "ack", len(ids), time.Since(started), err)
+	}
+}
+
+// streamShard returns shard number from name of shard stream "qu{N}_<name>".
+func streamShard(stream string) int {
+	start := strings.IndexByte(stream, '{')
+	end := strings.IndexByte(stream, '}')
+
+	if start == -1 || end < start {
+		return 0
+	}
+
+	shard, _ := strconv.Atoi(stream[start+1 : end])
+
+	return shard
 }
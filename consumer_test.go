@@ -1,6 +1,10 @@
 package ami
 
 import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -19,7 +23,7 @@ func TestNewConsumer(t *testing.T) {
 	ntf := newNotifier(t)
 
 	consOpt := ConsumerOptions{
-		Block:          time.Second,
+		Block:          time.Millisecond * 100,
 		ErrorNotifier:  ntf,
 		PipeBufferSize: 2,
 	}
@@ -75,6 +79,667 @@ func TestNewConsumer(t *testing.T) {
 	}
 }
 
+func TestNewConsumerWithClient(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	ntf := newNotifier(t)
+
+	rDB := redis.NewClient(&redis.Options{Addr: s.Addr()})
+	defer rDB.Close()
+
+	c, err := NewConsumerWithClient(ConsumerOptions{
+		Block:         time.Millisecond * 100,
+		ErrorNotifier: ntf,
+	}, rDB)
+	assert.NoError(t, err, "must not be an error")
+
+	p, err := NewProducerWithClient(ProducerOptions{ErrorNotifier: ntf}, rDB)
+	assert.NoError(t, err, "must not be an error")
+
+	ch := c.Start()
+
+	p.Send("ok")
+	p.Close()
+
+	select {
+	case msg := <-ch:
+		assert.Equal(t, "ok", msg.Body, "Got unexpected message")
+		c.Ack(msg)
+	case <-ntf.IsErr:
+		assert.FailNow(t, "got an error")
+	case <-time.After(time.Second):
+		assert.FailNow(t, "must not wait for a long time")
+	}
+
+	c.Stop()
+	c.Close()
+}
+
+func TestHeaders(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	ntf := newNotifier(t)
+
+	rdOpt := &redis.ClusterOptions{Addrs: []string{s.Addr()}}
+
+	c, err := NewConsumer(ConsumerOptions{
+		Block:         time.Millisecond * 100,
+		ErrorNotifier: ntf,
+	}, rdOpt)
+	assert.NoError(t, err, "must not be an error")
+
+	p, err := NewProducer(ProducerOptions{ErrorNotifier: ntf}, rdOpt)
+	assert.NoError(t, err, "must not be an error")
+
+	headers := map[string]string{"trace_id": "1", "content_type": "application/json"}
+
+	p.SendMessage(Message{Body: "{}", Headers: headers})
+	p.Close()
+
+	ch := c.Start()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-ch:
+			assert.Equal(t, "{}", msg.Body, "Got unexpected message")
+			assert.Equal(t, headers, msg.Headers, "Got unexpected headers")
+
+			if i == 0 {
+				assert.NoError(t, c.Nack(msg, 0), "must not be an error")
+			} else {
+				c.Ack(msg)
+			}
+		case <-ntf.IsErr:
+			assert.FailNow(t, "got an error")
+		case <-time.After(time.Second):
+			assert.FailNow(t, "must not wait for a long time")
+		}
+	}
+
+	c.Stop()
+	c.Close()
+}
+
+func TestStartContext(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	ntf := newNotifier(t)
+
+	rdOpt := &redis.ClusterOptions{Addrs: []string{s.Addr()}}
+
+	c, err := NewConsumer(ConsumerOptions{
+		Block:         time.Millisecond * 100,
+		ErrorNotifier: ntf,
+	}, rdOpt)
+	assert.NoError(t, err, "must not be an error")
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	ch := c.StartContext(ctx)
+
+	cancel()
+
+	select {
+	case _, more := <-ch:
+		assert.False(t, more, "channel must be closed")
+	case <-ntf.IsErr:
+		assert.FailNow(t, "got an error")
+	case <-time.After(time.Second):
+		assert.FailNow(t, "don't stopped in time")
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	err = c.CloseContext(ctx)
+	assert.NoError(t, err, "must not be an error")
+}
+
+func TestRun(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	ntf := &panicNotifier{Err: make(chan error, 1)}
+
+	rdOpt := &redis.ClusterOptions{Addrs: []string{s.Addr()}}
+
+	c, err := NewConsumer(ConsumerOptions{
+		Block:         time.Millisecond * 100,
+		ErrorNotifier: ntf,
+		Name:          "run",
+		ShardsCount:   1,
+	}, rdOpt)
+	assert.NoError(t, err, "must not be an error")
+
+	p, err := NewProducer(ProducerOptions{Name: "run", ShardsCount: 1}, rdOpt)
+	assert.NoError(t, err, "must not be an error")
+
+	p.Send("ok")
+	p.Send("error")
+	p.Send("panic")
+	p.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	got := make(chan string, 3)
+
+	handler := func(ctx context.Context, m Message) error {
+		got <- m.Body
+
+		switch m.Body {
+		case "error":
+			return errors.New("error")
+		case "panic":
+			panic("panic")
+		}
+
+		return nil
+	}
+
+	done := make(chan bool)
+
+	go func() {
+		c.Run(ctx, handler, 2)
+		done <- true
+	}()
+
+	for i := 0; i < 3; i++ {
+		select {
+		case <-got:
+		case <-time.After(time.Second):
+			assert.FailNow(t, "must not wait for a long time")
+		}
+	}
+
+	select {
+	case err := <-ntf.Err:
+		assert.Contains(t, err.Error(), "Panic in handler")
+	case <-time.After(time.Second):
+		assert.FailNow(t, "must got panic error")
+	}
+
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		assert.FailNow(t, "don't stopped in time")
+	}
+
+	c.Close()
+
+	// Only ACKed message is deleted
+	assert.Equal(t, int64(2), c.cl.rDB.XLen("qu{0}_run").Val())
+}
+
+func TestRunRedelivery(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	ntf := newNotifier(t)
+
+	rdOpt := &redis.ClusterOptions{Addrs: []string{s.Addr()}}
+
+	c, err := NewConsumer(ConsumerOptions{
+		Block:         time.Millisecond * 100,
+		ErrorNotifier: ntf,
+		MaxDeliveries: 2,
+		MinIdleTime:   time.Millisecond * 50,
+		Name:          "redelivery",
+		ReclaimPeriod: time.Millisecond * 100,
+		ShardsCount:   1,
+	}, rdOpt)
+	assert.NoError(t, err, "must not be an error")
+
+	p, err := NewProducer(ProducerOptions{Name: "redelivery", ShardsCount: 1}, rdOpt)
+	assert.NoError(t, err, "must not be an error")
+
+	p.Send("poison")
+	p.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var calls int32
+
+	done := make(chan bool)
+
+	go func() {
+		// Only consumer of queue gets own failed message again
+		c.Run(ctx, func(ctx context.Context, m Message) error {
+			atomic.AddInt32(&calls, 1)
+			return errors.New("boom")
+		}, 1)
+
+		done <- true
+	}()
+
+	assert.Eventually(t, func() bool {
+		lst, err := c.DeadMessages(10)
+		return err == nil && len(lst) == 1
+	}, time.Second*3, time.Millisecond*10)
+
+	cancel()
+	<-done
+	c.Close()
+
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+
+	lst, err := c.DeadMessages(10)
+	assert.NoError(t, err, "must not be an error")
+	assert.Equal(t, "Delivery count 3 exceeds MaxDeliveries 2: boom", lst[0].Error)
+}
+
+func TestRunCancel(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	ntf := newNotifier(t)
+	tr := &tracer{}
+
+	rdOpt := &redis.ClusterOptions{Addrs: []string{s.Addr()}}
+
+	c, err := NewConsumer(ConsumerOptions{
+		Block:         time.Millisecond * 100,
+		ErrorNotifier: ntf,
+		Name:          "runcancel",
+		ShardsCount:   1,
+		Tracer:        tr,
+	}, rdOpt)
+	assert.NoError(t, err, "must not be an error")
+
+	// Cluster client splits pipe with miniredis and may reorder messages
+	rDB := redis.NewClient(&redis.Options{Addr: s.Addr()})
+	defer rDB.Close()
+
+	p, err := NewProducerWithClient(ProducerOptions{Name: "runcancel", ShardsCount: 1}, rDB)
+	assert.NoError(t, err, "must not be an error")
+
+	for _, body := range []string{"nack", "ack", "cancel", "skipped", "skipped"} {
+		p.Send(body)
+	}
+
+	p.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var got []string
+
+	// Handler, that does Ack or Nack itself, overrides returned value
+	c.Run(ctx, func(ctx context.Context, m Message) error {
+		got = append(got, m.Body)
+
+		switch m.Body {
+		case "nack":
+			assert.NoError(t, c.Nack(m, time.Hour), "must not be an error")
+			return nil
+		case "ack":
+			c.Ack(m)
+			return errors.New("ignored")
+		}
+
+		cancel()
+
+		return nil
+	}, 1)
+
+	c.Close()
+
+	// Messages are not passed to handler after cancel and stay pending
+	assert.Equal(t, []string{"nack", "ack", "cancel"}, got)
+	assert.Equal(t, int64(2), c.cl.rDB.XLen("qu{0}_runcancel").Val())
+
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	events := map[string]int{}
+	for _, e := range tr.events {
+		events[e]++
+	}
+
+	// Trace of every got message is finished once
+	assert.Equal(t, 2, events["ack"])
+	assert.Equal(t, events["receive"], events["ack"]+events["nack"])
+}
+
+func TestNack(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	ntf := newNotifier(t)
+
+	rdOpt := &redis.ClusterOptions{Addrs: []string{s.Addr()}}
+
+	c, err := NewConsumer(ConsumerOptions{
+		Block:         time.Millisecond * 100,
+		DelayPeriod:   time.Millisecond * 10,
+		ErrorNotifier: ntf,
+		MaxDeliveries: 3,
+		Name:          "nack",
+		ShardsCount:   1,
+	}, rdOpt)
+	assert.NoError(t, err, "must not be an error")
+
+	p, err := NewProducer(ProducerOptions{
+		ErrorNotifier: ntf,
+		Name:          "nack",
+		ShardsCount:   1,
+	}, rdOpt)
+	assert.NoError(t, err, "must not be an error")
+
+	p.Send("ok")
+	p.Close()
+
+	ch := c.Start()
+
+	for i := 0; i < 3; i++ {
+		select {
+		case msg := <-ch:
+			assert.Equal(t, "ok", msg.Body, "Got unexpected message")
+			assert.Equal(t, i, msg.Retries, "Got unexpected retries count")
+
+			err := c.Nack(msg, time.Millisecond*time.Duration(i*50))
+			assert.NoError(t, err, "must not be an error")
+		case <-ntf.IsErr:
+			assert.FailNow(t, "got an error")
+		case <-time.After(time.Second * 3):
+			assert.FailNow(t, "must not wait for a long time")
+		}
+	}
+
+	lst, err := c.DeadMessages(10)
+	assert.NoError(t, err, "must not be an error")
+	assert.Len(t, lst, 1)
+	assert.Equal(t, int64(3), lst[0].Deliveries)
+
+	c.Stop()
+	c.Close()
+}
+
+func TestNackBytes(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	ntf := newNotifier(t)
+
+	rdOpt := &redis.ClusterOptions{Addrs: []string{s.Addr()}}
+
+	c, err := NewConsumer(ConsumerOptions{
+		Block:         time.Millisecond * 100,
+		DelayPeriod:   time.Millisecond * 10,
+		ErrorNotifier: ntf,
+		Name:          "nackbytes",
+		ShardsCount:   1,
+	}, rdOpt)
+	assert.NoError(t, err, "must not be an error")
+
+	p, err := NewProducer(ProducerOptions{
+		ErrorNotifier: ntf,
+		Name:          "nackbytes",
+		ShardsCount:   1,
+	}, rdOpt)
+	assert.NoError(t, err, "must not be an error")
+
+	body := []byte{0, 0xff, 0xfe}
+
+	p.SendBytes(body)
+	p.Close()
+
+	// Sorted set is empty
+	_, next, err := c.cl.moveDelayed(0, 10)
+	assert.NoError(t, err, "must not be an error")
+	assert.True(t, next.IsZero())
+
+	ch := c.Start()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case m := <-ch:
+			assert.Equal(t, body, m.Bytes())
+			assert.Equal(t, i, m.Retries)
+
+			if i == 0 {
+				assert.NoError(t, c.Nack(m, time.Millisecond*50), "must not be an error")
+			} else {
+				c.Ack(m)
+			}
+		case <-ntf.IsErr:
+			assert.FailNow(t, "got an error")
+		case <-time.After(time.Second * 3):
+			assert.FailNow(t, "must not wait for a long time")
+		}
+	}
+
+	c.Stop()
+	c.Close()
+}
+
+func TestConsumerMaxInFlightPipelines(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	rDB := redis.NewClient(&redis.Options{Addr: s.Addr()})
+	defer rDB.Close()
+
+	hook := &pipeHook{cmd: "xack"}
+	rDB.AddHook(hook)
+
+	c, err := NewConsumerWithClient(ConsumerOptions{
+		Block:                time.Millisecond * 100,
+		MaxInFlightPipelines: 1,
+		Name:                 "inflight",
+		PipeBufferSize:       1,
+		ShardsCount:          1,
+	}, rDB)
+	assert.NoError(t, err, "must not be an error")
+
+	p, err := NewProducerWithClient(ProducerOptions{
+		Name:        "inflight",
+		ShardsCount: 1,
+	}, rDB)
+	assert.NoError(t, err, "must not be an error")
+
+	for i := 0; i < 50; i++ {
+		p.Send("1")
+	}
+
+	p.Close()
+
+	ch := c.Start()
+
+	for i := 0; i < 50; i++ {
+		select {
+		case m := <-ch:
+			c.Ack(m)
+		case <-time.After(time.Second * 3):
+			assert.FailNow(t, "must not wait for a long time")
+		}
+	}
+
+	c.Stop()
+	c.Close()
+
+	assert.Len(t, c.inFlight, 0)
+	assert.Equal(t, 50, hook.total)
+	assert.Equal(t, 1, hook.max)
+}
+
+func TestReclaim(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	ntf := newNotifier(t)
+
+	rdOpt := &redis.ClusterOptions{Addrs: []string{s.Addr()}}
+
+	newConsumer := func(name string) *Consumer {
+		c, err := NewConsumer(ConsumerOptions{
+			Block:         time.Millisecond * 100,
+			Consumer:      name,
+			ErrorNotifier: ntf,
+			MinIdleTime:   time.Millisecond * 200,
+			Name:          "reclaim",
+			ReclaimPeriod: time.Millisecond * 50,
+			ShardsCount:   1,
+		}, rdOpt)
+		assert.NoError(t, err, "must not be an error")
+
+		return c
+	}
+
+	alice := newConsumer("alice")
+
+	p, err := NewProducer(ProducerOptions{
+		ErrorNotifier: ntf,
+		Name:          "reclaim",
+		ShardsCount:   1,
+	}, rdOpt)
+	assert.NoError(t, err, "must not be an error")
+
+	p.Send("1")
+	p.Close()
+
+	var (
+		id   string
+		read time.Time
+	)
+
+	// Alice dies without ACK of message
+	ch := alice.Start()
+
+	select {
+	case m := <-ch:
+		id = m.ID
+		read = time.Now()
+	case <-time.After(time.Second * 3):
+		assert.FailNow(t, "must not wait for a long time")
+	}
+
+	alice.Stop()
+	alice.Close()
+
+	bob := newConsumer("bob")
+	ch = bob.Start()
+
+	select {
+	case m := <-ch:
+		assert.Equal(t, id, m.ID)
+		assert.Equal(t, "1", m.Body)
+		assert.True(t, time.Since(read) >= time.Millisecond*190, "must be claimed after idle time")
+		bob.Ack(m)
+	case <-ntf.IsErr:
+		assert.FailNow(t, "got an error")
+	case <-time.After(time.Second * 3):
+		assert.FailNow(t, "must not wait for a long time")
+	}
+
+	bob.Stop()
+	bob.Close()
+
+	pending, err := bob.cl.rDB.XPending("qu{0}_reclaim", "qu_reclaim_group").Result()
+	assert.NoError(t, err, "must not be an error")
+	assert.Equal(t, int64(0), pending.Count)
+}
+
+func TestTracer(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	ntf := newNotifier(t)
+	tr := &tracer{}
+
+	rdOpt := &redis.ClusterOptions{Addrs: []string{s.Addr()}}
+
+	c, err := NewConsumer(ConsumerOptions{
+		Block:         time.Millisecond * 100,
+		ErrorNotifier: ntf,
+		Name:          "trace",
+		ShardsCount:   1,
+		Tracer:        tr,
+	}, rdOpt)
+	assert.NoError(t, err, "must not be an error")
+
+	p, err := NewProducer(ProducerOptions{
+		ErrorNotifier: ntf,
+		Name:          "trace",
+		ShardsCount:   1,
+		Tracer:        tr,
+	}, rdOpt)
+	assert.NoError(t, err, "must not be an error")
+
+	p.SendMessage(Message{Body: "1", Headers: map[string]string{"k": "v"}})
+	p.Send("2")
+	p.Close()
+
+	ch := c.Start()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-ch:
+			assert.Equal(t, "sent", msg.Headers["trace"])
+			assert.Equal(t, msg.ID, msg.Context().Value(tracerKey{}))
+
+			if msg.Body == "1" {
+				assert.Equal(t, "v", msg.Headers["k"])
+				c.Ack(msg)
+			} else {
+				assert.NoError(t, c.Nack(msg, time.Hour), "must not be an error")
+			}
+		case <-time.After(time.Second):
+			assert.FailNow(t, "must not wait for a long time")
+		}
+	}
+
+	c.Stop()
+	c.Close()
+
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	assert.ElementsMatch(t, []string{"send", "send", "sent", "sent", "receive", "receive", "ack", "nack"}, tr.events)
+}
+
+func TestNextID(t *testing.T) {
+	assert.Equal(t, "1526919030474-56", nextID("1526919030474-55"))
+	assert.Equal(t, "0-1", nextID("0-0"))
+	assert.Equal(t, "incorrect", nextID("incorrect"))
+}
+
 type notifier struct {
 	t     *testing.T
 	IsErr chan bool
@@ -88,3 +753,46 @@ func (n *notifier) AmiError(err error) {
 	n.IsErr <- true
 	assert.FailNow(n.t, err.Error(), "must not got an error from interface")
 }
+
+type panicNotifier struct {
+	Err chan error
+}
+
+func (n *panicNotifier) AmiError(err error) {
+	n.Err <- err
+}
+
+type tracerKey struct{}
+
+type tracer struct {
+	events []string
+	mu     sync.Mutex
+}
+
+func (t *tracer) event(e string) {
+	t.mu.Lock()
+	t.events = append(t.events, e)
+	t.mu.Unlock()
+}
+
+func (t *tracer) AmiSend(ctx context.Context, queue string, headers map[string]string) func(id string, err error) {
+	t.event("send")
+	headers["trace"] = "sent"
+
+	return func(id string, err error) {
+		t.event("sent")
+	}
+}
+
+func (t *tracer) AmiReceive(m Message) context.Context {
+	t.event("receive")
+	return context.WithValue(context.Background(), tracerKey{}, m.ID)
+}
+
+func (t *tracer) AmiAck(m Message) {
+	t.event("ack")
+}
+
+func (t *tracer) AmiNack(m Message, err error) {
+	t.event("nack")
+}
@@ -0,0 +1,132 @@
+package ami
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+)
+
+// Moves due messages from sorted set of delayed messages to stream.
+// KEYS[1] - stream, KEYS[2] - sorted set, ARGV[1] - current time in
+// milliseconds, ARGV[2] - maximum amount of moved messages.
+// Returns amount of moved messages and time of next delayed message in
+// milliseconds or -1, if there are no more messages.
+//
+// Member of sorted set is netstrings "<length>:<bytes>," of unique ID and
+// fields of message, so it is binary safe.
+var moveDelayedScript = redis.NewScript(`
+redis.replicate_commands()
+
+local due = redis.call('ZRANGEBYSCORE', KEYS[2], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+
+for _, member in ipairs(due) do
+	local fields = {}
+	local pos = 1
+
+	while pos <= #member do
+		local colon = string.find(member, ':', pos, true)
+		local len = tonumber(string.sub(member, pos, colon - 1))
+
+		table.insert(fields, string.sub(member, colon + 1, colon + len))
+		pos = colon + len + 2
+	end
+
+	-- First netstring is unique ID
+	table.remove(fields, 1)
+
+	redis.call('XADD', KEYS[1], '*', unpack(fields))
+	redis.call('ZREM', KEYS[2], member)
+end
+
+local next = redis.call('ZRANGE', KEYS[2], 0, 0, 'WITHSCORES')
+if #next == 0 then
+	return {#due, -1}
+end
+
+return {#due, tonumber(next[2])}
+`)
+
+// encodeDelayed encodes message to member of sorted set of delayed messages.
+// Unique is needed to not merge messages with same fields.
+func encodeDelayed(unique string, values map[string]interface{}) string {
+	var b strings.Builder
+
+	writeNetstring(&b, unique)
+
+	for k, v := range values {
+		writeNetstring(&b, k)
+
+		switch val := v.(type) {
+		case string:
+			writeNetstring(&b, val)
+		case []byte:
+			writeNetstring(&b, string(val))
+		default:
+			writeNetstring(&b, fmt.Sprint(val))
+		}
+	}
+
+	return b.String()
+}
+
+func writeNetstring(b *strings.Builder, s string) {
+	b.WriteString(strconv.Itoa(len(s)))
+	b.WriteByte(':')
+	b.WriteString(s)
+	b.WriteByte(',')
+}
+
+// moveDelayed moves due messages of shard to stream.
+// Returns amount of moved messages and time of next delayed message or zero
+// time, if there are no more delayed messages.
+func (c *client) moveDelayed(shard int, count int64) (int64, time.Time, error) {
+	stream := fmt.Sprintf("qu{%d}_%s", shard, c.opt.name)
+
+	res, err := moveDelayedScript.Run(
+		c.rDB,
+		[]string{stream, stream + "_delayed"},
+		time.Now().UnixNano()/int64(time.Millisecond),
+		count,
+	).Result()
+
+	if err != nil && err != redis.Nil {
+		return 0, time.Time{}, err
+	}
+
+	vals, ok := res.([]interface{})
+	if !ok || len(vals) != 2 {
+		return 0, time.Time{}, fmt.Errorf("Unexpected reply of moving of delayed messages: %v", res)
+	}
+
+	moved, _ := vals[0].(int64)
+	next, _ := vals[1].(int64)
+
+	if next == -1 {
+		return moved, time.Time{}, nil
+	}
+
+	return moved, time.Unix(0, next*int64(time.Millisecond)), nil
+}
+
+// addDelayed adds message to sorted set of delayed messages of shard, to move
+// it to stream at time.
+func (c *client) addDelayed(shard int, values map[string]interface{}, at time.Time) error {
+	unique := make([]byte, 8)
+	if _, err := rand.Read(unique); err != nil {
+		return err
+	}
+
+	member := encodeDelayed(hex.EncodeToString(unique), values)
+
+	stream := fmt.Sprintf("qu{%d}_%s", shard, c.opt.name)
+
+	return c.rDB.ZAdd(stream+"_delayed", &redis.Z{
+		Member: member,
+		Score:  float64(at.UnixNano() / int64(time.Millisecond)),
+	}).Err()
+}
@@ -0,0 +1,203 @@
+package ami
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+)
+
+// DeadMessages returns up to count oldest messages from dead-letter stream of
+// every shard of queue.
+func (c *Consumer) DeadMessages(count int64) ([]DeadMessage, error) {
+	var lst []DeadMessage
+
+	for i := 0; i < int(c.opt.ShardsCount); i++ {
+		stream := fmt.Sprintf("qu{%d}_%s_dlq", i, c.opt.Name)
+
+		res, err := c.cl.rDB.XRangeN(stream, "-", "+", count).Result()
+		if err != nil && err != redis.Nil {
+			return nil, err
+		}
+
+		for _, m := range res {
+			lst = append(lst, parseDeadMessage(stream, m))
+		}
+	}
+
+	return lst, nil
+}
+
+// DeadMessage returns message from dead-letter stream by it's ID.
+func (c *Consumer) DeadMessage(stream string, id string) (DeadMessage, error) {
+	res, err := c.cl.rDB.XRangeN(stream, id, id, 1).Result()
+	if err != nil && err != redis.Nil {
+		return DeadMessage{}, err
+	}
+
+	if len(res) == 0 {
+		return DeadMessage{}, fmt.Errorf("No message with id %s in stream %s", id, stream)
+	}
+
+	return parseDeadMessage(stream, res[0]), nil
+}
+
+// Requeue moves message from dead-letter stream back to queue stream, from
+// which it was moved.
+//
+// Message is added to queue as new message, with new ID. It is got only by
+// group, from which it was moved, if AckMode is not AckAndDelete.
+func (c *Consumer) Requeue(m DeadMessage) error {
+	values := setHeaders(map[string]interface{}{"m": m.Body}, m.Headers)
+
+	// Other groups already got this message
+	if c.opt.AckMode != AckAndDelete && m.Group != "" {
+		values[groupField] = m.Group
+	}
+
+	pipe := c.cl.rDB.TxPipeline()
+
+	pipe.XAdd(&redis.XAddArgs{
+		ID:     "*",
+		Stream: m.OriginalStream,
+		Values: values,
+	})
+	pipe.XDel(m.Stream, m.ID)
+
+	_, err := pipe.Exec()
+
+	return err
+}
+
+// deliveries returns delivery counts of messages, read by this consumer.
+func (c *Consumer) deliveries(stream string, group string, msgs []redis.XMessage) (map[string]int64, error) {
+	pending, err := c.cl.rDB.XPendingExt(&redis.XPendingExtArgs{
+		Consumer: c.opt.Consumer,
+		Count:    int64(len(msgs)),
+		End:      msgs[len(msgs)-1].ID,
+		Group:    group,
+		Start:    msgs[0].ID,
+		Stream:   stream,
+	}).Result()
+
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int64, len(pending))
+	for _, p := range pending {
+		counts[p.ID] = p.RetryCount
+	}
+
+	return counts, nil
+}
+
+// Field of message, returned to queue by NackWithError, with error of
+// processing
+const errorField = "e"
+
+// Time to live of last error of message, that stays pending after error of
+// handler in Run
+const lastErrorTTL = time.Hour * 24
+
+// lastErrorKey returns key with last error of message, that stays pending
+// after error of handler in Run. Key has same hash tag as stream.
+func lastErrorKey(stream string, id string) string {
+	return stream + "_error:" + id
+}
+
+// setLastError stores error of handler to write it to dead-letter stream, if
+// message will exceed MaxDeliveries.
+func (c *Consumer) setLastError(m Message, cause error) {
+	if c.opt.MaxDeliveries == 0 {
+		return
+	}
+
+	err := c.cl.rDB.Set(lastErrorKey(m.Stream, m.ID), cause.Error(), lastErrorTTL).Err()
+	if err != nil && c.notif != nil {
+		c.notif.AmiError(err)
+	}
+}
+
+// deadLetter moves message to dead-letter stream of same shard.
+//
+// Last error of message, passed to NackWithError or returned by handler in
+// Run, is added to reason.
+// Dead-letter stream has same hash tag, so all is done in one transaction.
+func (c *Consumer) deadLetter(stream string, group string, m redis.XMessage, deliveries int64, reason string) error {
+	body, ok := m.Values["m"]
+	if !ok {
+		body = ""
+	}
+
+	errKey := lastErrorKey(stream, m.ID)
+
+	// Error of handler in Run is later then error of NackWithError, that
+	// returned message to queue
+	cause, err := c.cl.rDB.Get(errKey).Result()
+	if err == redis.Nil {
+		cause, _ = m.Values[errorField].(string)
+	} else if err != nil {
+		return err
+	}
+
+	if cause != "" {
+		reason += ": " + cause
+	}
+
+	pipe := c.cl.rDB.TxPipeline()
+
+	pipe.XAdd(&redis.XAddArgs{
+		ID:     "*",
+		Stream: stream + "_dlq",
+		Values: setHeaders(map[string]interface{}{
+			"deliveries": deliveries,
+			"error":      reason,
+			"group":      group,
+			"id":         m.ID,
+			"m":          body,
+			"stream":     stream,
+		}, parseHeaders(m.Values)),
+	})
+	ackPipe(pipe, c.opt.AckMode, stream, group, m.ID)
+	pipe.Del(errKey)
+
+	_, err = pipe.Exec()
+
+	return err
+}
+
+func parseDeadMessage(stream string, m redis.XMessage) DeadMessage {
+	msg := DeadMessage{
+		Headers: parseHeaders(m.Values),
+		ID:      m.ID,
+		Stream:  stream,
+	}
+
+	if v, ok := m.Values["m"].(string); ok {
+		msg.Body = v
+	}
+
+	if v, ok := m.Values["id"].(string); ok {
+		msg.OriginalID = v
+	}
+
+	if v, ok := m.Values["stream"].(string); ok {
+		msg.OriginalStream = v
+	}
+
+	if v, ok := m.Values["error"].(string); ok {
+		msg.Error = v
+	}
+
+	if v, ok := m.Values["group"].(string); ok {
+		msg.Group = v
+	}
+
+	if v, ok := m.Values["deliveries"].(string); ok {
+		msg.Deliveries, _ = strconv.ParseInt(v, 10, 64)
+	}
+
+	return msg
+}
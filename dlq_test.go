@@ -0,0 +1,354 @@
+package ami
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v7"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeadMessages(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	ntf := newNotifier(t)
+
+	rdOpt := &redis.ClusterOptions{Addrs: []string{s.Addr()}}
+
+	c, err := NewConsumer(ConsumerOptions{
+		Block:         time.Millisecond * 100,
+		ErrorNotifier: ntf,
+		Name:          "dlq",
+		ShardsCount:   1,
+	}, rdOpt)
+	assert.NoError(t, err, "must not be an error")
+
+	p, err := NewProducer(ProducerOptions{
+		ErrorNotifier: ntf,
+		Name:          "dlq",
+		ShardsCount:   1,
+	}, rdOpt)
+	assert.NoError(t, err, "must not be an error")
+
+	p.Send("poison")
+	p.Close()
+
+	ch := c.Start()
+
+	var msg Message
+
+	select {
+	case msg = <-ch:
+	case <-time.After(time.Second):
+		assert.FailNow(t, "must not wait for a long time")
+	}
+
+	err = c.deadLetter(msg.Stream, msg.Group, redis.XMessage{
+		ID:     msg.ID,
+		Values: map[string]interface{}{"m": msg.Body},
+	}, 3, "test")
+	assert.NoError(t, err, "must not be an error")
+
+	lst, err := c.DeadMessages(10)
+	assert.NoError(t, err, "must not be an error")
+	assert.Len(t, lst, 1)
+	assert.Equal(t, "poison", lst[0].Body)
+	assert.Equal(t, msg.ID, lst[0].OriginalID)
+	assert.Equal(t, msg.Stream, lst[0].OriginalStream)
+	assert.Equal(t, "qu_dlq_group", lst[0].Group)
+	assert.Equal(t, int64(3), lst[0].Deliveries)
+	assert.Equal(t, "test", lst[0].Error)
+
+	dm, err := c.DeadMessage(lst[0].Stream, lst[0].ID)
+	assert.NoError(t, err, "must not be an error")
+	assert.Equal(t, lst[0], dm)
+
+	_, err = c.DeadMessage(lst[0].Stream, "0-1")
+	assert.Error(t, err, "must be an error")
+
+	err = c.Requeue(dm)
+	assert.NoError(t, err, "must not be an error")
+
+	select {
+	case msg = <-ch:
+		assert.Equal(t, "poison", msg.Body)
+		c.Ack(msg)
+	case <-time.After(time.Second * 3):
+		assert.FailNow(t, "must not wait for a long time")
+	}
+
+	lst, err = c.DeadMessages(10)
+	assert.NoError(t, err, "must not be an error")
+	assert.Len(t, lst, 0)
+
+	c.Stop()
+	c.Close()
+}
+
+func TestRequeueGroup(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	ntf := newNotifier(t)
+
+	// Cluster client splits pipe with miniredis and may reorder messages
+	rDB := redis.NewClient(&redis.Options{Addr: s.Addr()})
+	defer rDB.Close()
+
+	p, err := NewProducerWithClient(ProducerOptions{
+		ErrorNotifier: ntf,
+		Groups:        []string{"billing", "audit"},
+		Name:          "dlqgroup",
+		ShardsCount:   1,
+	}, rDB)
+	assert.NoError(t, err, "must not be an error")
+
+	p.Send("poison")
+	p.Close()
+
+	newConsumer := func(group string) (*Consumer, chan Message) {
+		c, err := NewConsumerWithClient(ConsumerOptions{
+			AckMode:       AckAndDeleteAcked,
+			Block:         time.Millisecond * 100,
+			ErrorNotifier: ntf,
+			Group:         group,
+			Name:          "dlqgroup",
+			ShardsCount:   1,
+		}, rDB)
+		assert.NoError(t, err, "must not be an error")
+
+		return c, c.Start()
+	}
+
+	// receive returns bodies of messages, got by consumer of group
+	receive := func(group string) []string {
+		c, ch := newConsumer(group)
+
+		var got []string
+
+	loop:
+		for {
+			select {
+			case m := <-ch:
+				got = append(got, m.Body)
+				c.Ack(m)
+			case <-ntf.IsErr:
+				assert.FailNow(t, "got an error")
+			case <-time.After(time.Millisecond * 300):
+				break loop
+			}
+		}
+
+		c.Stop()
+		c.Close()
+
+		return got
+	}
+
+	billing, ch := newConsumer("billing")
+
+	var msg Message
+
+	select {
+	case msg = <-ch:
+	case <-time.After(time.Second):
+		assert.FailNow(t, "must not wait for a long time")
+	}
+
+	err = billing.deadLetter(msg.Stream, msg.Group, redis.XMessage{
+		ID:     msg.ID,
+		Values: map[string]interface{}{"m": msg.Body},
+	}, 3, "test")
+	assert.NoError(t, err, "must not be an error")
+
+	lst, err := billing.DeadMessages(10)
+	assert.NoError(t, err, "must not be an error")
+	assert.Len(t, lst, 1)
+	assert.Equal(t, "billing", lst[0].Group)
+
+	assert.NoError(t, billing.Requeue(lst[0]), "must not be an error")
+
+	billing.Stop()
+	billing.Close()
+
+	// Requeued message is got only by billing group
+	assert.Equal(t, []string{"poison"}, receive("audit"))
+	assert.Equal(t, []string{"poison"}, receive("billing"))
+	assert.Equal(t, int64(0), rDB.XLen("qu{0}_dlqgroup").Val())
+}
+
+func TestMaxDeliveries(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	ntf := newNotifier(t)
+
+	rdOpt := &redis.ClusterOptions{Addrs: []string{s.Addr()}}
+
+	newConsumer := func() *Consumer {
+		c, err := NewConsumer(ConsumerOptions{
+			Block:         time.Millisecond * 100,
+			ErrorNotifier: ntf,
+			MaxDeliveries: 2,
+			Name:          "deliveries",
+			ShardsCount:   1,
+		}, rdOpt)
+		assert.NoError(t, err, "must not be an error")
+
+		return c
+	}
+
+	c := newConsumer()
+
+	p, err := NewProducer(ProducerOptions{
+		ErrorNotifier: ntf,
+		Name:          "deliveries",
+		ShardsCount:   1,
+	}, rdOpt)
+	assert.NoError(t, err, "must not be an error")
+
+	p.Send("poison")
+	p.Close()
+
+	// Message stays pending after error of handler and is got again from
+	// backlog after restart of consumer
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+
+		c.Run(ctx, func(ctx context.Context, m Message) error {
+			cancel()
+			return fmt.Errorf("boom %d", i)
+		}, 1)
+
+		assert.Equal(t, context.Canceled, ctx.Err())
+
+		c.Close()
+		c = newConsumer()
+	}
+
+	ch := c.Start()
+
+	assert.Eventually(t, func() bool {
+		lst, err := c.DeadMessages(10)
+		return err == nil && len(lst) == 1
+	}, time.Second*3, time.Millisecond*10)
+
+	lst, err := c.DeadMessages(10)
+	assert.NoError(t, err, "must not be an error")
+	assert.Equal(t, "poison", lst[0].Body)
+	assert.Equal(t, int64(3), lst[0].Deliveries)
+	assert.Equal(t, "Delivery count 3 exceeds MaxDeliveries 2: boom 1", lst[0].Error)
+
+	select {
+	case m := <-ch:
+		assert.FailNow(t, "got unexpected message "+m.Body)
+	case <-time.After(time.Millisecond * 200):
+	}
+
+	c.Stop()
+	c.Close()
+
+	// Error of Nack is written to dead-letter stream too
+	c = newConsumer()
+
+	p, err = NewProducer(ProducerOptions{
+		ErrorNotifier: ntf,
+		Name:          "deliveries",
+		ShardsCount:   1,
+	}, rdOpt)
+	assert.NoError(t, err, "must not be an error")
+
+	p.Send("nacked")
+	p.Close()
+
+	ch = c.Start()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case m := <-ch:
+			assert.NoError(t, c.NackWithError(m, 0, fmt.Errorf("nack %d", i)), "must not be an error")
+		case <-time.After(time.Second * 3):
+			assert.FailNow(t, "must not wait for a long time")
+		}
+	}
+
+	c.Stop()
+	c.Close()
+
+	lst, err = c.DeadMessages(10)
+	assert.NoError(t, err, "must not be an error")
+	assert.Len(t, lst, 2)
+	assert.Equal(t, "Retries count 2 exceeds MaxDeliveries 2: nack 1", lst[1].Error)
+
+	// Last error of handler is deleted with message
+	assert.Equal(t, int64(0), c.cl.rDB.Exists(lastErrorKey(lst[0].OriginalStream, lst[0].OriginalID)).Val())
+
+	// Error of handler after Nack is written instead of error of Nack
+	c = newConsumer()
+
+	p, err = NewProducer(ProducerOptions{
+		ErrorNotifier: ntf,
+		Name:          "deliveries",
+		ShardsCount:   1,
+	}, rdOpt)
+	assert.NoError(t, err, "must not be an error")
+
+	p.Send("mixed")
+	p.Close()
+
+	ch = c.Start()
+
+	select {
+	case m := <-ch:
+		assert.NoError(t, c.NackWithError(m, 0, errors.New("nack")), "must not be an error")
+	case <-time.After(time.Second * 3):
+		assert.FailNow(t, "must not wait for a long time")
+	}
+
+	c.Stop()
+	c.Close()
+
+	// Retry of Nack is counted as delivery too
+	c = newConsumer()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+
+	c.Run(ctx, func(ctx context.Context, m Message) error {
+		cancel()
+		return errors.New("boom")
+	}, 1)
+
+	assert.Equal(t, context.Canceled, ctx.Err())
+
+	c.Close()
+
+	c = newConsumer()
+	c.Start()
+
+	assert.Eventually(t, func() bool {
+		lst, err := c.DeadMessages(10)
+		return err == nil && len(lst) == 3
+	}, time.Second*3, time.Millisecond*10)
+
+	lst, err = c.DeadMessages(10)
+	assert.NoError(t, err, "must not be an error")
+	assert.Equal(t, "mixed", lst[2].Body)
+	assert.Equal(t, "Delivery count 3 exceeds MaxDeliveries 2: boom", lst[2].Error)
+
+	c.Stop()
+	c.Close()
+}
@@ -0,0 +1,45 @@
+package ami
+
+import "context"
+
+// Future is result of asynchronous sending of message with SendAsync.
+//
+// Future is resolved after pipe with message is executed in Redis.
+type Future struct {
+	done chan struct{}
+	err  error
+	id   string
+}
+
+func newFuture() *Future {
+	return &Future{done: make(chan struct{})}
+}
+
+// Done returns channel, that is closed, when Future is resolved.
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Result locks until Future is resolved and returns ID of message in Redis
+// stream or error, if message was not sent.
+func (f *Future) Result() (string, error) {
+	<-f.done
+	return f.id, f.err
+}
+
+// Wait is same as Result, but returns context error, if context is done before
+// Future is resolved.
+func (f *Future) Wait(ctx context.Context) (string, error) {
+	select {
+	case <-f.done:
+		return f.id, f.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+func (f *Future) resolve(id string, err error) {
+	f.id = id
+	f.err = err
+	close(f.done)
+}
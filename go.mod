@@ -3,12 +3,15 @@ module github.com/kak-tus/ami
 go 1.13
 
 require (
-	github.com/alicebob/miniredis/v2 v2.11.4
+	github.com/alicebob/miniredis/v2 v2.23.1
+	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/go-redis/redis/v7 v7.2.0
+	github.com/golang/protobuf v1.4.2 // indirect
 	github.com/imdario/mergo v0.3.9
 	github.com/onsi/ginkgo v1.11.0 // indirect
 	github.com/onsi/gomega v1.8.1 // indirect
 	github.com/ssgreg/repeat v1.5.0
 	github.com/stretchr/testify v1.5.1
+	golang.org/x/sys v0.0.0-20200615200032-f1bc736245b1 // indirect
 	gopkg.in/yaml.v2 v2.2.7 // indirect
 )
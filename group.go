@@ -0,0 +1,107 @@
+package ami
+
+import (
+	"fmt"
+
+	"github.com/go-redis/redis/v7"
+)
+
+// Field of message, returned to queue by Nack, with group of consumer, that
+// did Nack. Consumers of other groups ACK such message without delivery.
+const groupField = "g"
+
+// ACKs messages and deletes messages, that are delivered to all groups of
+// stream and are not pending in them.
+// KEYS[1] - stream, ARGV[1] - group, ARGV[2...] - IDs of messages.
+//
+// Script does XPENDING for every message and group and blocks Redis while it
+// runs, so IDs are passed to it by chunks of ackAckedChunk.
+const ackAckedScript = `
+redis.replicate_commands()
+
+local function parse(id)
+	local ms, seq = string.match(id, '^(%d+)-(%d+)$')
+	return tonumber(ms), tonumber(seq)
+end
+
+local function less(a, b)
+	local ams, aseq = parse(a)
+	local bms, bseq = parse(b)
+
+	if ams ~= bms then
+		return ams < bms
+	end
+
+	return aseq < bseq
+end
+
+local groups = {}
+
+for _, info in ipairs(redis.call('XINFO', 'GROUPS', KEYS[1])) do
+	local g = {}
+
+	for i = 1, #info, 2 do
+		g[info[i]] = info[i + 1]
+	end
+
+	table.insert(groups, g)
+end
+
+local deleted = 0
+
+for i = 2, #ARGV do
+	local id = ARGV[i]
+	local acked = true
+
+	redis.call('XACK', KEYS[1], ARGV[1], id)
+
+	for _, g in ipairs(groups) do
+		if less(g['last-delivered-id'], id) or #redis.call('XPENDING', KEYS[1], g['name'], id, id, 1) > 0 then
+			acked = false
+			break
+		end
+	end
+
+	if acked then
+		deleted = deleted + redis.call('XDEL', KEYS[1], id)
+	end
+end
+
+return deleted
+`
+
+// Maximum amount of IDs in one call of ackAckedScript
+const ackAckedChunk = 100
+
+func defaultGroup(name string) string {
+	return fmt.Sprintf("qu_%s_group", name)
+}
+
+// ackPipe adds ACK of messages to transaction by mode.
+func ackPipe(pipe redis.Pipeliner, mode AckMode, stream string, group string, ids ...string) {
+	switch mode {
+	case AckAndDeleteAcked:
+		for len(ids) > 0 {
+			chunk := ids
+			if len(chunk) > ackAckedChunk {
+				chunk = chunk[:ackAckedChunk]
+			}
+
+			ids = ids[len(chunk):]
+
+			args := make([]interface{}, 0, len(chunk)+1)
+			args = append(args, group)
+
+			for _, id := range chunk {
+				args = append(args, id)
+			}
+
+			pipe.Eval(ackAckedScript, []string{stream}, args...)
+		}
+	case AckOnly:
+		pipe.XAck(stream, group, ids...)
+	default:
+		pipe.XAck(stream, group, ids...)
+		pipe.XDel(stream, ids...)
+	}
+}
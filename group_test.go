@@ -0,0 +1,281 @@
+package ami
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v7"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGroups(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	ntf := newNotifier(t)
+
+	// Cluster client splits pipe with miniredis and may reorder messages
+	rDB := redis.NewClient(&redis.Options{Addr: s.Addr()})
+	defer rDB.Close()
+
+	p, err := NewProducerWithClient(ProducerOptions{
+		ErrorNotifier: ntf,
+		Groups:        []string{"alpha", "beta"},
+		Name:          "groups",
+		ShardsCount:   1,
+	}, rDB)
+	assert.NoError(t, err, "must not be an error")
+
+	p.Send("1")
+	p.Send("2")
+	p.Close()
+
+	newConsumer := func(group string) *Consumer {
+		c, err := NewConsumerWithClient(ConsumerOptions{
+			AckMode:       AckAndDeleteAcked,
+			Block:         time.Millisecond * 100,
+			ErrorNotifier: ntf,
+			Group:         group,
+			Name:          "groups",
+			ShardsCount:   1,
+		}, rDB)
+		assert.NoError(t, err, "must not be an error")
+
+		return c
+	}
+
+	receive := func(c *Consumer, ch chan Message) Message {
+		select {
+		case m := <-ch:
+			assert.Equal(t, c.opt.Group, m.Group)
+			return m
+		case <-ntf.IsErr:
+			assert.FailNow(t, "got an error")
+		case <-time.After(time.Second * 3):
+			assert.FailNow(t, "must not wait for a long time")
+		}
+
+		return Message{}
+	}
+
+	alpha := newConsumer("alpha")
+	ch := alpha.Start()
+
+	m := receive(alpha, ch)
+	assert.Equal(t, "1", m.Body)
+	alpha.Ack(m)
+
+	m = receive(alpha, ch)
+	assert.Equal(t, "2", m.Body)
+	assert.NoError(t, alpha.Nack(m, 0), "must not be an error")
+
+	m = receive(alpha, ch)
+	assert.Equal(t, "2", m.Body)
+	assert.Equal(t, 1, m.Retries)
+	alpha.Ack(m)
+
+	alpha.Stop()
+	alpha.Close()
+
+	// Messages and nacked copy are not deleted until they are got by beta
+	assert.Equal(t, int64(3), p.cl.rDB.XLen("qu{0}_groups").Val())
+
+	beta := newConsumer("beta")
+	ch = beta.Start()
+
+	for _, body := range []string{"1", "2"} {
+		m := receive(beta, ch)
+		assert.Equal(t, body, m.Body)
+		assert.Equal(t, 0, m.Retries)
+		beta.Ack(m)
+	}
+
+	// Message, nacked by alpha, is not got by beta
+	select {
+	case m := <-ch:
+		assert.FailNow(t, "got unexpected message "+m.Body)
+	case <-time.After(time.Millisecond * 300):
+	}
+
+	beta.Stop()
+	beta.Close()
+
+	assert.Equal(t, int64(0), p.cl.rDB.XLen("qu{0}_groups").Val())
+}
+
+func TestAckOnly(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	ntf := newNotifier(t)
+
+	rdOpt := &redis.ClusterOptions{Addrs: []string{s.Addr()}}
+
+	c, err := NewConsumer(ConsumerOptions{
+		AckMode:       AckOnly,
+		Block:         time.Millisecond * 100,
+		ErrorNotifier: ntf,
+		Name:          "ackonly",
+		ShardsCount:   1,
+	}, rdOpt)
+	assert.NoError(t, err, "must not be an error")
+
+	p, err := NewProducer(ProducerOptions{
+		ErrorNotifier: ntf,
+		Name:          "ackonly",
+		ShardsCount:   1,
+	}, rdOpt)
+	assert.NoError(t, err, "must not be an error")
+
+	p.Send("1")
+	p.Send("2")
+	p.Close()
+
+	ch := c.Start()
+
+	for i := 0; i < 3; i++ {
+		select {
+		case m := <-ch:
+			if m.Body == "2" && m.Retries == 0 {
+				assert.NoError(t, c.Nack(m, 0), "must not be an error")
+			} else {
+				c.Ack(m)
+			}
+		case <-ntf.IsErr:
+			assert.FailNow(t, "got an error")
+		case <-time.After(time.Second * 3):
+			assert.FailNow(t, "must not wait for a long time")
+		}
+	}
+
+	c.Stop()
+	c.Close()
+
+	// Messages and nacked copy stay in stream, but are not pending
+	assert.Equal(t, int64(3), c.cl.rDB.XLen("qu{0}_ackonly").Val())
+
+	pending, err := c.cl.rDB.XPending("qu{0}_ackonly", c.opt.Group).Result()
+	assert.NoError(t, err, "must not be an error")
+	assert.Equal(t, int64(0), pending.Count)
+}
+
+func TestGroupStartID(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	rDB := redis.NewClient(&redis.Options{Addr: s.Addr()})
+	defer rDB.Close()
+
+	// Stream is created without group by someone else
+	err = rDB.XAdd(&redis.XAddArgs{
+		ID:     "*",
+		Stream: "qu{0}_start",
+		Values: map[string]interface{}{"m": "existing"},
+	}).Err()
+	assert.NoError(t, err, "must not be an error")
+
+	c, err := NewConsumerWithClient(ConsumerOptions{
+		Block:        time.Millisecond * 100,
+		GroupStartID: "0",
+		Name:         "start",
+		RetryPolicy:  RetryPolicy{BaseDelay: time.Millisecond * 10},
+		ShardsCount:  1,
+	}, rDB)
+	assert.NoError(t, err, "must not be an error")
+
+	ch := c.Start()
+
+	receive := func(body string) {
+		select {
+		case m := <-ch:
+			assert.Equal(t, body, m.Body)
+			c.Ack(m)
+		case <-time.After(time.Second * 3):
+			assert.FailNow(t, "must not wait for a long time")
+		}
+	}
+
+	receive("existing")
+
+	assert.Eventually(t, func() bool {
+		return rDB.XLen("qu{0}_start").Val() == 0
+	}, time.Second, time.Millisecond*10)
+
+	// Group is created again, if it is deleted
+	assert.NoError(t, rDB.XGroupDestroy("qu{0}_start", "qu_start_group").Err(), "must not be an error")
+
+	err = rDB.XAdd(&redis.XAddArgs{
+		ID:     "*",
+		Stream: "qu{0}_start",
+		Values: map[string]interface{}{"m": "new"},
+	}).Err()
+	assert.NoError(t, err, "must not be an error")
+
+	receive("new")
+
+	c.Stop()
+	c.Close()
+}
+
+func TestAckAckedChunks(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	rDB := redis.NewClient(&redis.Options{Addr: s.Addr()})
+	defer rDB.Close()
+
+	c, err := NewConsumerWithClient(ConsumerOptions{
+		AckMode:     AckAndDeleteAcked,
+		Name:        "chunks",
+		ShardsCount: 1,
+	}, rDB)
+	assert.NoError(t, err, "must not be an error")
+
+	for i := 0; i < 250; i++ {
+		err := rDB.XAdd(&redis.XAddArgs{
+			Stream: "qu{0}_chunks",
+			Values: map[string]interface{}{"m": "1"},
+		}).Err()
+		assert.NoError(t, err, "must not be an error")
+	}
+
+	res, err := rDB.XReadGroup(&redis.XReadGroupArgs{
+		Consumer: "alice",
+		Group:    "qu_chunks_group",
+		Streams:  []string{"qu{0}_chunks", ">"},
+	}).Result()
+	assert.NoError(t, err, "must not be an error")
+
+	var ids []string
+
+	for _, m := range res[0].Messages {
+		ids = append(ids, m.ID)
+	}
+
+	assert.Len(t, ids, 250)
+
+	pipe := rDB.TxPipeline()
+	ackPipe(pipe, c.opt.AckMode, "qu{0}_chunks", "qu_chunks_group", ids...)
+
+	cmds, err := pipe.Exec()
+	assert.NoError(t, err, "must not be an error")
+	assert.Len(t, cmds, 3)
+
+	assert.Equal(t, int64(0), rDB.XLen("qu{0}_chunks").Val())
+	assert.Equal(t, int64(0), rDB.XPending("qu{0}_chunks", "qu_chunks_group").Val().Count)
+
+	c.Close()
+}
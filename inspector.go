@@ -0,0 +1,483 @@
+package ami
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/imdario/mergo"
+)
+
+// NewInspector creates new inspector client for Ami
+func NewInspector(opt InspectorOptions, ropt *redis.ClusterOptions) (*Inspector, error) {
+	return newInspector(opt, clientOptions{ropt: ropt})
+}
+
+// NewInspectorWithClient creates new inspector client for Ami with externally
+// supplied Redis client.
+func NewInspectorWithClient(opt InspectorOptions, rDB redis.UniversalClient) (*Inspector, error) {
+	return newInspector(opt, clientOptions{rDB: rDB})
+}
+
+func newInspector(opt InspectorOptions, copt clientOptions) (*Inspector, error) {
+	if err := mergo.Merge(&opt, defaultInspectorOptions); err != nil {
+		return nil, err
+	}
+
+	if opt.Group == "" {
+		opt.Group = defaultGroup(opt.Name)
+	}
+
+	copt.name = opt.Name
+	copt.shardsCount = opt.ShardsCount
+
+	// Inspector must not create queue, so client is not initialized
+	cl := &client{
+		opt: copt,
+		rDB: newRedis(copt),
+	}
+
+	return &Inspector{cl: cl, opt: opt}, nil
+}
+
+// Stats returns state of all shards of queue and aggregated state.
+func (i *Inspector) Stats() (QueueStats, error) {
+	stats := QueueStats{
+		Name:   i.opt.Name,
+		Shards: make([]ShardStats, i.opt.ShardsCount),
+	}
+
+	for shard := 0; shard < int(i.opt.ShardsCount); shard++ {
+		s, err := i.ShardStats(shard)
+		if err != nil {
+			return QueueStats{}, err
+		}
+
+		stats.Shards[shard] = s
+		stats.Length += s.Length
+
+		for _, g := range s.Groups {
+			stats.Pending += g.Pending
+
+			if g.Lag == -1 || stats.Lag == -1 {
+				stats.Lag = -1
+			} else {
+				stats.Lag += g.Lag
+			}
+		}
+	}
+
+	return stats, nil
+}
+
+// ShardStats returns state of one shard of queue.
+func (i *Inspector) ShardStats(shard int) (ShardStats, error) {
+	stream := fmt.Sprintf("qu{%d}_%s", shard, i.opt.Name)
+
+	stats := ShardStats{Stream: stream}
+
+	length, err := i.cl.rDB.XLen(stream).Result()
+	if err != nil && err != redis.Nil {
+		return ShardStats{}, err
+	}
+
+	stats.Length = length
+
+	// Not existing stream has no groups
+	if length == 0 {
+		exists, err := i.cl.rDB.Exists(stream).Result()
+		if err != nil {
+			return ShardStats{}, err
+		}
+
+		if exists == 0 {
+			return stats, nil
+		}
+	}
+
+	groups, err := i.cl.xinfo("GROUPS", stream)
+	if err != nil {
+		return ShardStats{}, err
+	}
+
+	for _, info := range groups {
+		g := GroupStats{
+			Name:            infoString(info, "name"),
+			Pending:         infoInt(info, "pending", 0),
+			LastDeliveredID: infoString(info, "last-delivered-id"),
+			Lag:             infoInt(info, "lag", -1),
+		}
+
+		consumers, err := i.cl.xinfo("CONSUMERS", stream, g.Name)
+		if err != nil {
+			return ShardStats{}, err
+		}
+
+		for _, cinfo := range consumers {
+			g.Consumers = append(g.Consumers, ConsumerStats{
+				Name:    infoString(cinfo, "name"),
+				Pending: infoInt(cinfo, "pending", 0),
+				Idle:    time.Duration(infoInt(cinfo, "idle", 0)) * time.Millisecond,
+			})
+		}
+
+		stats.Groups = append(stats.Groups, g)
+	}
+
+	return stats, nil
+}
+
+// Peek returns up to count oldest messages from every shard of queue.
+//
+// Messages are not read by consumer group and stay in queue.
+func (i *Inspector) Peek(count int64) ([]Message, error) {
+	group := i.opt.Group
+
+	var lst []Message
+
+	for shard := 0; shard < int(i.opt.ShardsCount); shard++ {
+		stream := fmt.Sprintf("qu{%d}_%s", shard, i.opt.Name)
+
+		res, err := i.cl.rDB.XRangeN(stream, "-", "+", count).Result()
+		if err != nil && err != redis.Nil {
+			return nil, err
+		}
+
+		for _, m := range res {
+			// Messages of incorrect format are returned too
+			msg, _ := parseMessage(stream, group, m)
+			lst = append(lst, msg)
+		}
+	}
+
+	return lst, nil
+}
+
+// Tail calls fn for every new message, added to any shard of queue, until
+// context is done or error occurs.
+//
+// Messages are not read by consumer group and stay in queue.
+// fn is never called concurrently.
+func (i *Inspector) Tail(ctx context.Context, fn func(Message)) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	group := i.opt.Group
+
+	cErr := make(chan error, i.opt.ShardsCount)
+	mu := sync.Mutex{}
+
+	for shard := 0; shard < int(i.opt.ShardsCount); shard++ {
+		stream := fmt.Sprintf("qu{%d}_%s", shard, i.opt.Name)
+
+		go func() {
+			lastID := "$"
+
+			for ctx.Err() == nil {
+				res, err := i.cl.rDB.XRead(&redis.XReadArgs{
+					Block:   time.Second,
+					Count:   100,
+					Streams: []string{stream, lastID},
+				}).Result()
+
+				if err != nil && err != redis.Nil {
+					cErr <- err
+					return
+				}
+
+				for _, s := range res {
+					for _, m := range s.Messages {
+						lastID = m.ID
+
+						msg, _ := parseMessage(stream, group, m)
+
+						mu.Lock()
+						fn(msg)
+						mu.Unlock()
+					}
+				}
+			}
+
+			cErr <- nil
+		}()
+	}
+
+	var err error
+
+	for shard := 0; shard < int(i.opt.ShardsCount); shard++ {
+		if e := <-cErr; e != nil && err == nil {
+			err = e
+			cancel()
+		}
+	}
+
+	return err
+}
+
+// Purge deletes all messages from all shards of queue.
+//
+// Consumer group and consumers are kept. Returns amount of deleted messages.
+func (i *Inspector) Purge() (int64, error) {
+	var total int64
+
+	for shard := 0; shard < int(i.opt.ShardsCount); shard++ {
+		stream := fmt.Sprintf("qu{%d}_%s", shard, i.opt.Name)
+
+		cnt, err := i.cl.rDB.XTrim(stream, 0).Result()
+		if err != nil && err != redis.Nil {
+			return total, err
+		}
+
+		total += cnt
+	}
+
+	return total, nil
+}
+
+// RequeuePending returns pending messages of consumer of Group back to queue
+// as new messages, so they can be got by any consumer of Group.
+//
+// Original messages are ACKed by AckMode. New messages are got only by Group,
+// if AckMode is not AckAndDelete.
+// If consumer is empty - pending messages of all consumers are requeued.
+// Only messages, that idle at least minIdle, are requeued.
+// Returns amount of requeued messages.
+func (i *Inspector) RequeuePending(consumer string, minIdle time.Duration) (int64, error) {
+	group := i.opt.Group
+
+	var total int64
+
+	for shard := 0; shard < int(i.opt.ShardsCount); shard++ {
+		stream := fmt.Sprintf("qu{%d}_%s", shard, i.opt.Name)
+
+		cnt, err := i.requeueShard(stream, group, consumer, minIdle)
+		total += cnt
+
+		if err != nil {
+			return total, err
+		}
+	}
+
+	return total, nil
+}
+
+// Temporary consumer, that owns messages while they are requeued
+const requeueConsumer = "ami-requeue"
+
+func (i *Inspector) requeueShard(stream string, group string, consumer string, minIdle time.Duration) (int64, error) {
+	var total int64
+
+	start := "-"
+
+	for {
+		pending, err := i.cl.rDB.XPendingExt(&redis.XPendingExtArgs{
+			Consumer: consumer,
+			Count:    100,
+			End:      "+",
+			Group:    group,
+			Start:    start,
+			Stream:   stream,
+		}).Result()
+
+		if err != nil && err != redis.Nil {
+			return total, err
+		}
+
+		ids := make([]string, 0, len(pending))
+
+		for _, p := range pending {
+			if p.Consumer == requeueConsumer || p.Idle < minIdle {
+				continue
+			}
+
+			ids = append(ids, p.ID)
+		}
+
+		if len(ids) != 0 {
+			// Claim messages first to not requeue messages, that are ACKed or
+			// claimed by other consumer right now
+			res, err := i.cl.rDB.XClaim(&redis.XClaimArgs{
+				Consumer: requeueConsumer,
+				Group:    group,
+				Messages: ids,
+				MinIdle:  minIdle,
+				Stream:   stream,
+			}).Result()
+
+			if err != nil && err != redis.Nil {
+				return total, err
+			}
+
+			if len(res) != 0 {
+				pipe := i.cl.rDB.TxPipeline()
+
+				for _, m := range res {
+					values := make(map[string]interface{}, len(m.Values)+1)
+					for k, v := range m.Values {
+						values[k] = v
+					}
+
+					// Other groups already got this message or will get
+					// original message
+					if i.opt.AckMode != AckAndDelete {
+						values[groupField] = group
+					}
+
+					pipe.XAdd(&redis.XAddArgs{
+						ID:     "*",
+						Stream: stream,
+						Values: values,
+					})
+					ackPipe(pipe, i.opt.AckMode, stream, group, m.ID)
+				}
+
+				if _, err := pipe.Exec(); err != nil {
+					return total, err
+				}
+
+				total += int64(len(res))
+			}
+		}
+
+		if len(pending) < 100 {
+			break
+		}
+
+		start = nextID(pending[len(pending)-1].ID)
+	}
+
+	err := i.cl.rDB.XGroupDelConsumer(stream, group, requeueConsumer).Err()
+	if err != nil && err != redis.Nil {
+		return total, err
+	}
+
+	return total, nil
+}
+
+// DeleteConsumer deletes consumer from Group of all shards of queue.
+//
+// Pending messages of consumer are deleted from group too and will not be
+// processed by other consumers, so call RequeuePending before.
+// Returns amount of deleted pending messages.
+func (i *Inspector) DeleteConsumer(consumer string) (int64, error) {
+	group := i.opt.Group
+
+	var total int64
+
+	for shard := 0; shard < int(i.opt.ShardsCount); shard++ {
+		stream := fmt.Sprintf("qu{%d}_%s", shard, i.opt.Name)
+
+		cnt, err := i.cl.rDB.XGroupDelConsumer(stream, group, consumer).Result()
+		if err != nil && err != redis.Nil {
+			return total, err
+		}
+
+		total += cnt
+	}
+
+	return total, nil
+}
+
+// CreateGroup creates consumer group on all shards of queue, positioned at
+// stream ID start, to replay messages of queue.
+//
+// Group gets all messages with IDs greater then start, that are still in
+// streams: "0" - all messages, "$" - only new messages. Use TimeID to get
+// start by time. Messages, deleted by ACK of other groups, can't be replayed,
+// so use AckOnly mode of consumers with Retention of producer for queues,
+// that may be replayed.
+// Start Consumer with Group option to read created group. Use AckOnly or
+// AckAndDeleteAcked mode in it to not delete messages of other groups.
+func (i *Inspector) CreateGroup(group string, start string) error {
+	for shard := 0; shard < int(i.opt.ShardsCount); shard++ {
+		stream := fmt.Sprintf("qu{%d}_%s", shard, i.opt.Name)
+
+		err := i.cl.rDB.XGroupCreateMkStream(stream, group, start).Err()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DeleteGroup deletes consumer group with all it's consumers and pending
+// messages from all shards of queue.
+//
+// Delete replay groups after use, because messages are not deleted in
+// AckAndDeleteAcked mode, until they are got by all groups.
+func (i *Inspector) DeleteGroup(group string) error {
+	for shard := 0; shard < int(i.opt.ShardsCount); shard++ {
+		stream := fmt.Sprintf("qu{%d}_%s", shard, i.opt.Name)
+
+		err := i.cl.rDB.XGroupDestroy(stream, group).Err()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// TimeID returns stream ID for CreateGroup, so group gets messages, added to
+// queue at or after t. Precision of IDs is millisecond.
+// For t at or before Unix epoch "0-0" is returned - all messages.
+func TimeID(t time.Time) string {
+	ms := t.UnixNano() / int64(time.Millisecond)
+	if ms <= 0 {
+		return "0-0"
+	}
+
+	// Group gets messages with IDs greater then ID, so take maximum ID of
+	// previous millisecond
+	return fmt.Sprintf("%d-%d", ms-1, uint64(math.MaxUint64))
+}
+
+// xinfo returns reply of XINFO GROUPS or XINFO CONSUMERS command as list of
+// maps.
+func (c *client) xinfo(args ...interface{}) ([]map[string]interface{}, error) {
+	cmd := redis.NewSliceCmd(append([]interface{}{"XINFO"}, args...)...)
+
+	err := c.rDB.Process(cmd)
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	res := make([]map[string]interface{}, 0, len(cmd.Val()))
+
+	for _, v := range cmd.Val() {
+		fields, ok := v.([]interface{})
+		if !ok {
+			continue
+		}
+
+		info := make(map[string]interface{}, len(fields)/2)
+
+		for j := 0; j+1 < len(fields); j += 2 {
+			if k, ok := fields[j].(string); ok {
+				info[k] = fields[j+1]
+			}
+		}
+
+		res = append(res, info)
+	}
+
+	return res, nil
+}
+
+func infoString(info map[string]interface{}, key string) string {
+	v, _ := info[key].(string)
+	return v
+}
+
+func infoInt(info map[string]interface{}, key string, def int64) int64 {
+	v, ok := info[key].(int64)
+	if !ok {
+		return def
+	}
+
+	return v
+}
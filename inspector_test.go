@@ -0,0 +1,456 @@
+package ami
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v7"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInspector(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	ntf := newNotifier(t)
+
+	rdOpt := &redis.ClusterOptions{Addrs: []string{s.Addr()}}
+
+	i, err := NewInspector(InspectorOptions{Name: "inspect", ShardsCount: 2}, rdOpt)
+	assert.NoError(t, err, "must not be an error")
+
+	stats, err := i.Stats()
+	assert.NoError(t, err, "must not be an error")
+	assert.Equal(t, int64(0), stats.Length)
+	assert.Len(t, stats.Shards, 2)
+
+	c, err := NewConsumer(ConsumerOptions{
+		Block:         time.Millisecond * 100,
+		Consumer:      "alice",
+		ErrorNotifier: ntf,
+		Name:          "inspect",
+		ShardsCount:   1,
+	}, rdOpt)
+	assert.NoError(t, err, "must not be an error")
+
+	p, err := NewProducer(ProducerOptions{
+		ErrorNotifier: ntf,
+		Name:          "inspect",
+		ShardsCount:   1,
+	}, rdOpt)
+	assert.NoError(t, err, "must not be an error")
+
+	p.Send("1")
+	p.Send("2")
+	p.Close()
+
+	ch := c.Start()
+
+	select {
+	case <-ch:
+	case <-time.After(time.Second):
+		assert.FailNow(t, "must not wait for a long time")
+	}
+
+	stats, err = i.Stats()
+	assert.NoError(t, err, "must not be an error")
+	assert.Equal(t, int64(2), stats.Length)
+	assert.Equal(t, int64(2), stats.Pending)
+	assert.Equal(t, int64(-1), stats.Lag)
+
+	g := stats.Shards[0].Groups[0]
+	assert.Equal(t, "qu_inspect_group", g.Name)
+	assert.Equal(t, "alice", g.Consumers[0].Name)
+	assert.Equal(t, int64(2), g.Consumers[0].Pending)
+
+	c.Stop()
+	c.Close()
+}
+
+func TestInspectorOperations(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	ntf := newNotifier(t)
+
+	rdOpt := &redis.ClusterOptions{Addrs: []string{s.Addr()}}
+
+	i, err := NewInspector(InspectorOptions{Name: "operate", ShardsCount: 1}, rdOpt)
+	assert.NoError(t, err, "must not be an error")
+
+	c, err := NewConsumer(ConsumerOptions{
+		Block:         time.Millisecond * 100,
+		Consumer:      "alice",
+		ErrorNotifier: ntf,
+		Name:          "operate",
+		ShardsCount:   1,
+	}, rdOpt)
+	assert.NoError(t, err, "must not be an error")
+
+	// Cluster client splits pipe with miniredis and may reorder messages
+	rDB := redis.NewClient(&redis.Options{Addr: s.Addr()})
+	defer rDB.Close()
+
+	p, err := NewProducerWithClient(ProducerOptions{
+		ErrorNotifier: ntf,
+		Name:          "operate",
+		ShardsCount:   1,
+	}, rDB)
+	assert.NoError(t, err, "must not be an error")
+
+	p.SendMessage(Message{Body: "1", Headers: map[string]string{"k": "v"}})
+	p.Send("2")
+	p.Close()
+
+	lst, err := i.Peek(10)
+	assert.NoError(t, err, "must not be an error")
+	assert.Len(t, lst, 2)
+	assert.Equal(t, "1", lst[0].Body)
+	assert.Equal(t, "v", lst[0].Headers["k"])
+	assert.Equal(t, "2", lst[1].Body)
+
+	ch := c.Start()
+
+	for n := 0; n < 2; n++ {
+		select {
+		case <-ch:
+		case <-time.After(time.Second):
+			assert.FailNow(t, "must not wait for a long time")
+		}
+	}
+
+	c.Stop()
+
+	cnt, err := i.RequeuePending("bob", 0)
+	assert.NoError(t, err, "must not be an error")
+	assert.Equal(t, int64(0), cnt)
+
+	cnt, err = i.RequeuePending("alice", 0)
+	assert.NoError(t, err, "must not be an error")
+	assert.Equal(t, int64(2), cnt)
+
+	stats, err := i.Stats()
+	assert.NoError(t, err, "must not be an error")
+	assert.Equal(t, int64(2), stats.Length)
+	assert.Equal(t, int64(0), stats.Pending)
+
+	lst, err = i.Peek(10)
+	assert.NoError(t, err, "must not be an error")
+	assert.Len(t, lst, 2)
+
+	for _, m := range lst {
+		if m.Body == "1" {
+			assert.Equal(t, "v", m.Headers["k"])
+		} else {
+			assert.Equal(t, "2", m.Body)
+		}
+	}
+
+	cnt, err = i.DeleteConsumer("alice")
+	assert.NoError(t, err, "must not be an error")
+	assert.Equal(t, int64(0), cnt)
+
+	cnt, err = i.Purge()
+	assert.NoError(t, err, "must not be an error")
+	assert.Equal(t, int64(2), cnt)
+
+	stats, err = i.Stats()
+	assert.NoError(t, err, "must not be an error")
+	assert.Equal(t, int64(0), stats.Length)
+
+	c.Close()
+}
+
+func TestInspectorGroup(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	ntf := newNotifier(t)
+
+	rDB := redis.NewClient(&redis.Options{Addr: s.Addr()})
+	defer rDB.Close()
+
+	p, err := NewProducerWithClient(ProducerOptions{
+		ErrorNotifier: ntf,
+		Groups:        []string{"billing", "audit"},
+		Name:          "operategroup",
+		ShardsCount:   1,
+	}, rDB)
+	assert.NoError(t, err, "must not be an error")
+
+	p.Send("1")
+	p.Close()
+
+	newConsumer := func(group string) (*Consumer, chan Message) {
+		c, err := NewConsumerWithClient(ConsumerOptions{
+			AckMode:       AckAndDeleteAcked,
+			Block:         time.Millisecond * 100,
+			Consumer:      "alice",
+			ErrorNotifier: ntf,
+			Group:         group,
+			Name:          "operategroup",
+			ShardsCount:   1,
+		}, rDB)
+		assert.NoError(t, err, "must not be an error")
+
+		return c, c.Start()
+	}
+
+	receive := func(ch chan Message) Message {
+		select {
+		case m := <-ch:
+			return m
+		case <-time.After(time.Second * 3):
+			assert.FailNow(t, "must not wait for a long time")
+		}
+
+		return Message{}
+	}
+
+	billing, ch := newConsumer("billing")
+	assert.Equal(t, "1", receive(ch).Body)
+	billing.Stop()
+	billing.Close()
+
+	i, err := NewInspectorWithClient(InspectorOptions{
+		AckMode:     AckAndDeleteAcked,
+		Group:       "billing",
+		Name:        "operategroup",
+		ShardsCount: 1,
+	}, rDB)
+	assert.NoError(t, err, "must not be an error")
+
+	cnt, err := i.RequeuePending("alice", 0)
+	assert.NoError(t, err, "must not be an error")
+	assert.Equal(t, int64(1), cnt)
+
+	// Original message stays for audit group
+	lst, err := i.Peek(10)
+	assert.NoError(t, err, "must not be an error")
+	assert.Len(t, lst, 2)
+	assert.Equal(t, "billing", lst[0].Group)
+
+	// Requeued copy is got only by billing group
+	audit, ch := newConsumer("audit")
+	m := receive(ch)
+	assert.Equal(t, "1", m.Body)
+	audit.Ack(m)
+
+	select {
+	case m := <-ch:
+		assert.FailNow(t, "got unexpected message "+m.Body)
+	case <-time.After(time.Millisecond * 300):
+	}
+
+	audit.Stop()
+	audit.Close()
+
+	billing, ch = newConsumer("billing")
+	m = receive(ch)
+	assert.Equal(t, "1", m.Body)
+	billing.Stop()
+	billing.Close()
+
+	cnt, err = i.DeleteConsumer("alice")
+	assert.NoError(t, err, "must not be an error")
+	assert.Equal(t, int64(1), cnt)
+}
+
+func TestInspectorRequeueAckMode(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	rDB := redis.NewClient(&redis.Options{Addr: s.Addr()})
+	defer rDB.Close()
+
+	stream := "qu{0}_requeuemode"
+
+	// requeue returns messages of stream after requeue of message, pending in
+	// billing group
+	requeue := func(mode AckMode, audited bool) []redis.XMessage {
+		assert.NoError(t, rDB.FlushAll().Err(), "must not be an error")
+
+		for _, group := range []string{"billing", "audit"} {
+			err := rDB.XGroupCreateMkStream(stream, group, "$").Err()
+			assert.NoError(t, err, "must not be an error")
+		}
+
+		err := rDB.XAdd(&redis.XAddArgs{
+			Stream: stream,
+			Values: map[string]interface{}{"m": "1"},
+		}).Err()
+		assert.NoError(t, err, "must not be an error")
+
+		read := func(group string) {
+			res, err := rDB.XReadGroup(&redis.XReadGroupArgs{
+				Consumer: "alice",
+				Group:    group,
+				Streams:  []string{stream, ">"},
+			}).Result()
+			assert.NoError(t, err, "must not be an error")
+			assert.Len(t, res[0].Messages, 1)
+		}
+
+		read("billing")
+
+		if audited {
+			read("audit")
+			assert.NoError(t, rDB.XAck(stream, "audit", rDB.XRange(stream, "-", "+").Val()[0].ID).Err())
+		}
+
+		i, err := NewInspectorWithClient(InspectorOptions{
+			AckMode:     mode,
+			Group:       "billing",
+			Name:        "requeuemode",
+			ShardsCount: 1,
+		}, rDB)
+		assert.NoError(t, err, "must not be an error")
+
+		cnt, err := i.RequeuePending("alice", 0)
+		assert.NoError(t, err, "must not be an error")
+		assert.Equal(t, int64(1), cnt)
+		assert.Equal(t, int64(0), rDB.XPending(stream, "billing").Val().Count)
+
+		return rDB.XRange(stream, "-", "+").Val()
+	}
+
+	// Original message is deleted, other groups get copy
+	lst := requeue(AckAndDelete, false)
+	assert.Len(t, lst, 1)
+	assert.NotContains(t, lst[0].Values, groupField)
+
+	// Original message stays for audit group, that didn't get it
+	lst = requeue(AckAndDeleteAcked, false)
+	assert.Len(t, lst, 2)
+	assert.Equal(t, "billing", lst[1].Values[groupField])
+
+	// Original message is deleted, because billing group ACKs it last
+	lst = requeue(AckAndDeleteAcked, true)
+	assert.Len(t, lst, 1)
+	assert.Equal(t, "billing", lst[0].Values[groupField])
+
+	// Original message stays in stream
+	lst = requeue(AckOnly, true)
+	assert.Len(t, lst, 2)
+	assert.Equal(t, "billing", lst[1].Values[groupField])
+}
+
+func TestInspectorReplay(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	ntf := newNotifier(t)
+
+	// Cluster client splits pipe with miniredis and may reorder messages
+	rDB := redis.NewClient(&redis.Options{Addr: s.Addr()})
+	defer rDB.Close()
+
+	i, err := NewInspectorWithClient(InspectorOptions{Name: "replay", ShardsCount: 1}, rDB)
+	assert.NoError(t, err, "must not be an error")
+
+	p, err := NewProducerWithClient(ProducerOptions{
+		ErrorNotifier: ntf,
+		Name:          "replay",
+		ShardsCount:   1,
+	}, rDB)
+	assert.NoError(t, err, "must not be an error")
+
+	p.Send("old")
+	p.Close()
+
+	lst, err := i.Peek(1)
+	assert.NoError(t, err, "must not be an error")
+	assert.Len(t, lst, 1)
+
+	// IDs of messages have precision of milliseconds
+	time.Sleep(time.Millisecond * 2)
+	from := time.Now()
+	time.Sleep(time.Millisecond * 2)
+
+	p, err = NewProducerWithClient(ProducerOptions{
+		ErrorNotifier: ntf,
+		Name:          "replay",
+		ShardsCount:   1,
+	}, rDB)
+	assert.NoError(t, err, "must not be an error")
+
+	p.Send("1")
+	p.Send("2")
+	p.Close()
+
+	assert.NoError(t, i.CreateGroup("since", TimeID(from)), "must not be an error")
+	assert.NoError(t, i.CreateGroup("all", "0"), "must not be an error")
+	assert.Error(t, i.CreateGroup("all", "0"), "must be an error")
+
+	replay := func(group string) []string {
+		c, err := NewConsumerWithClient(ConsumerOptions{
+			AckMode:       AckOnly,
+			Block:         time.Millisecond * 100,
+			ErrorNotifier: ntf,
+			Group:         group,
+			Name:          "replay",
+			ShardsCount:   1,
+		}, rDB)
+		assert.NoError(t, err, "must not be an error")
+
+		ch := c.Start()
+
+		var got []string
+
+	loop:
+		for {
+			select {
+			case m := <-ch:
+				got = append(got, m.Body)
+				c.Ack(m)
+			case <-ntf.IsErr:
+				assert.FailNow(t, "got an error")
+			case <-time.After(time.Millisecond * 300):
+				break loop
+			}
+		}
+
+		c.Stop()
+		c.Close()
+
+		return got
+	}
+
+	assert.Equal(t, []string{"1", "2"}, replay("since"))
+	assert.Equal(t, []string{"old", "1", "2"}, replay("all"))
+
+	assert.NoError(t, i.DeleteGroup("since"), "must not be an error")
+
+	stats, err := i.Stats()
+	assert.NoError(t, err, "must not be an error")
+
+	var groups []string
+	for _, g := range stats.Shards[0].Groups {
+		groups = append(groups, g.Name)
+	}
+
+	assert.ElementsMatch(t, []string{"qu_replay_group", "all"}, groups)
+}
+
+func TestTimeID(t *testing.T) {
+	assert.Equal(t, "0-0", TimeID(time.Unix(0, 0)))
+	assert.Equal(t, "0-0", TimeID(time.Unix(-10, 0)))
+	assert.Equal(t, "0-18446744073709551615", TimeID(time.Unix(0, int64(time.Millisecond))))
+	assert.Equal(t, "1999-18446744073709551615", TimeID(time.Unix(2, 0)))
+}
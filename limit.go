@@ -0,0 +1,64 @@
+package ami
+
+import "sync"
+
+// bytesLimit limits total size of messages in send buffer of producer.
+type bytesLimit struct {
+	freed   chan struct{} // Closed and replaced, when bytes are released
+	max     int64
+	mu      sync.Mutex
+	used    int64
+	waiting bool
+}
+
+func newBytesLimit(max int64) *bytesLimit {
+	return &bytesLimit{freed: make(chan struct{}), max: max}
+}
+
+// tryAcquire reserves n bytes, if they are available. Message bigger than
+// limit is accepted, if there are no other messages.
+// Returns channel, that is closed, when some bytes are released, if bytes are
+// not available.
+func (l *bytesLimit) tryAcquire(n int64) (bool, <-chan struct{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.used == 0 || l.used+n <= l.max {
+		l.used += n
+		return true, nil
+	}
+
+	l.waiting = true
+
+	return false, l.freed
+}
+
+func (l *bytesLimit) release(n int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.used -= n
+
+	if l.waiting {
+		close(l.freed)
+		l.freed = make(chan struct{})
+		l.waiting = false
+	}
+}
+
+// size returns size of message body and headers in bytes.
+func (m toSend) size() int64 {
+	size := len(m.body)
+
+	if m.extra == nil {
+		return int64(size)
+	}
+
+	size += len(m.extra.bytes)
+
+	for k, v := range m.extra.headers {
+		size += len(k) + len(v)
+	}
+
+	return int64(size)
+}
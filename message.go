@@ -0,0 +1,98 @@
+package ami
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/go-redis/redis/v7"
+)
+
+// Prefix of stream fields with message headers
+const headerPrefix = "h:"
+
+// Bytes returns Body of message as byte slice.
+//
+// Slice is a copy of Body, so it can be modified.
+func (m Message) Bytes() []byte {
+	return []byte(m.Body)
+}
+
+// Context returns context of message, set by Tracer of consumer.
+//
+// Returns context.Background(), if Tracer is not set.
+func (m Message) Context() context.Context {
+	if m.ctx == nil {
+		return context.Background()
+	}
+
+	return m.ctx
+}
+
+// settle marks message, got in Run, as ACKed or nacked.
+func (m Message) settle() {
+	if m.settled != nil {
+		atomic.StoreInt32(m.settled, 1)
+	}
+}
+
+// parseMessage converts stream entry to Message.
+// Returns error, if entry has incorrect format, but Message with IDs is filled
+// anyway to allow ACK it.
+func parseMessage(stream string, group string, m redis.XMessage) (Message, error) {
+	msg := Message{
+		Group:  group,
+		ID:     m.ID,
+		Stream: stream,
+	}
+
+	v, ok := m.Values["m"]
+	if !ok {
+		return msg, errors.New("Incorrect message format: no \"m\" field in message with id " + m.ID)
+	}
+
+	msg.Body = v.(string)
+	msg.Headers = parseHeaders(m.Values)
+
+	if r, ok := m.Values["r"]; ok {
+		msg.Retries, _ = strconv.Atoi(r.(string))
+	}
+
+	return msg, nil
+}
+
+// setHeaders adds headers to values of stream entry as separate fields.
+func setHeaders(values map[string]interface{}, headers map[string]string) map[string]interface{} {
+	for k, v := range headers {
+		values[headerPrefix+k] = v
+	}
+
+	return values
+}
+
+// parseHeaders gets headers from values of stream entry.
+// Returns nil if there are no headers.
+func parseHeaders(values map[string]interface{}) map[string]string {
+	var headers map[string]string
+
+	for k, v := range values {
+		if !strings.HasPrefix(k, headerPrefix) {
+			continue
+		}
+
+		s, ok := v.(string)
+		if !ok {
+			continue
+		}
+
+		if headers == nil {
+			headers = make(map[string]string)
+		}
+
+		headers[strings.TrimPrefix(k, headerPrefix)] = s
+	}
+
+	return headers
+}
@@ -0,0 +1,17 @@
+module github.com/kak-tus/ami/otel
+
+// OpenTelemetry requires Go 1.16 or later
+go 1.16
+
+require (
+	github.com/alicebob/miniredis/v2 v2.23.1
+	github.com/go-redis/redis/v7 v7.2.0
+	github.com/kak-tus/ami v0.0.0
+	github.com/stretchr/testify v1.7.0
+	go.opentelemetry.io/otel v1.3.0
+	go.opentelemetry.io/otel/sdk v1.3.0
+	go.opentelemetry.io/otel/trace v1.3.0
+)
+
+// Local version of Ami is used until root module is tagged
+replace github.com/kak-tus/ami => ../
@@ -0,0 +1,159 @@
+// Package otel provides OpenTelemetry tracer for Ami.
+//
+// Tracer implements ami.Tracer. Set it as Tracer in options of producers and
+// consumers:
+//
+//	tracer := otel.NewTracer()
+//
+//	pr, err := ami.NewProducer(ami.ProducerOptions{
+//		Name:   "ruthie",
+//		Tracer: tracer,
+//	}, ropt)
+//
+// Producer creates "<queue> publish" span for every sent message, child of
+// span from context of Send call, and injects it's context to message
+// headers. Consumer creates "<queue> process" span for every got message with
+// link to producer span. Span is ended on Ack or Nack of message. Use
+// Message.Context() to create child spans of it.
+package otel
+
+import (
+	"context"
+
+	"github.com/kak-tus/ami"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/kak-tus/ami/otel"
+
+// Tracer traces messages of Ami producers and consumers with OpenTelemetry.
+type Tracer struct {
+	prop   propagation.TextMapPropagator
+	tracer trace.Tracer
+}
+
+var _ ami.Tracer = &Tracer{}
+
+// Option configures Tracer.
+type Option func(t *Tracer)
+
+// WithTracerProvider sets provider of tracer. Default is global provider.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(t *Tracer) {
+		t.tracer = tp.Tracer(instrumentationName)
+	}
+}
+
+// WithPropagator sets propagator, that injects and extracts context of trace
+// to and from message headers. Default is global propagator.
+func WithPropagator(prop propagation.TextMapPropagator) Option {
+	return func(t *Tracer) {
+		t.prop = prop
+	}
+}
+
+// NewTracer creates new tracer.
+func NewTracer(opts ...Option) *Tracer {
+	t := &Tracer{}
+
+	for _, o := range opts {
+		o(t)
+	}
+
+	if t.tracer == nil {
+		t.tracer = otel.GetTracerProvider().Tracer(instrumentationName)
+	}
+
+	if t.prop == nil {
+		t.prop = otel.GetTextMapPropagator()
+	}
+
+	return t
+}
+
+// AmiSend implements ami.Tracer.
+func (t *Tracer) AmiSend(ctx context.Context, queue string, headers map[string]string) func(id string, err error) {
+	ctx, span := t.tracer.Start(ctx, queue+" publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "redis"),
+			attribute.String("messaging.destination.name", queue),
+			attribute.String("messaging.operation", "publish"),
+		),
+	)
+
+	t.prop.Inject(ctx, propagation.MapCarrier(headers))
+
+	return func(id string, err error) {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		} else {
+			span.SetAttributes(attribute.String("messaging.message.id", id))
+		}
+
+		span.End()
+	}
+}
+
+// AmiReceive implements ami.Tracer.
+func (t *Tracer) AmiReceive(m ami.Message) context.Context {
+	ctx := t.prop.Extract(context.Background(), propagation.MapCarrier(m.Headers))
+	queue := queueName(m)
+
+	opts := []trace.SpanStartOption{
+		trace.WithNewRoot(),
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "redis"),
+			attribute.String("messaging.destination.name", queue),
+			attribute.String("messaging.consumer.group.name", m.Group),
+			attribute.String("ami.stream", m.Stream),
+			attribute.String("messaging.message.id", m.ID),
+			attribute.String("messaging.operation", "process"),
+			attribute.Int("messaging.message.retries", m.Retries),
+		),
+	}
+
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		opts = append(opts, trace.WithLinks(trace.Link{SpanContext: sc}))
+	}
+
+	ctx, _ = t.tracer.Start(ctx, queue+" process", opts...)
+
+	return ctx
+}
+
+// AmiAck implements ami.Tracer.
+func (t *Tracer) AmiAck(m ami.Message) {
+	trace.SpanFromContext(m.Context()).End()
+}
+
+// AmiNack implements ami.Tracer.
+func (t *Tracer) AmiNack(m ami.Message, err error) {
+	span := trace.SpanFromContext(m.Context())
+
+	span.SetAttributes(attribute.Bool("messaging.message.nacked", true))
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
+
+// queueName returns queue name from name of shard stream "qu{N}_<name>".
+func queueName(m ami.Message) string {
+	for i := 0; i < len(m.Stream); i++ {
+		if m.Stream[i] == '_' {
+			return m.Stream[i+1:]
+		}
+	}
+
+	return m.Stream
+}
@@ -0,0 +1,152 @@
+package otel
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v7"
+	"github.com/kak-tus/ami"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTracer(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	rec := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+
+	tracer := NewTracer(
+		WithTracerProvider(tp),
+		WithPropagator(propagation.TraceContext{}),
+	)
+
+	rdOpt := &redis.ClusterOptions{Addrs: []string{s.Addr()}}
+
+	c, err := ami.NewConsumer(ami.ConsumerOptions{
+		Block:       time.Millisecond * 100,
+		Name:        "traced",
+		ShardsCount: 1,
+		Tracer:      tracer,
+	}, rdOpt)
+	assert.NoError(t, err, "must not be an error")
+
+	p, err := ami.NewProducer(ami.ProducerOptions{
+		Name:        "traced",
+		ShardsCount: 1,
+		Tracer:      tracer,
+	}, rdOpt)
+	assert.NoError(t, err, "must not be an error")
+
+	ctx, parent := tp.Tracer("test").Start(context.Background(), "request")
+
+	id, err := p.SendSync(ctx, "1")
+	assert.NoError(t, err, "must not be an error")
+
+	parent.End()
+	p.Close()
+
+	ch := c.Start()
+
+	var msg ami.Message
+
+	select {
+	case msg = <-ch:
+	case <-time.After(time.Second):
+		assert.FailNow(t, "must not wait for a long time")
+	}
+
+	assert.Equal(t, id, msg.ID)
+	assert.NotEmpty(t, msg.Headers["traceparent"])
+	assert.True(t, trace.SpanContextFromContext(msg.Context()).IsValid())
+
+	c.Ack(msg)
+	c.Stop()
+	c.Close()
+
+	spans := rec.Ended()
+	assert.Len(t, spans, 3)
+
+	var publish, process sdktrace.ReadOnlySpan
+
+	for _, sp := range spans {
+		switch sp.Name() {
+		case "traced publish":
+			publish = sp
+		case "traced process":
+			process = sp
+		}
+	}
+
+	if !assert.NotNil(t, publish) || !assert.NotNil(t, process) {
+		return
+	}
+
+	assert.Equal(t, parent.SpanContext().TraceID(), publish.SpanContext().TraceID())
+	assert.Equal(t, trace.SpanKindProducer, publish.SpanKind())
+	assert.Equal(t, trace.SpanKindConsumer, process.SpanKind())
+	assert.NotEqual(t, publish.SpanContext().TraceID(), process.SpanContext().TraceID())
+	assert.Len(t, process.Links(), 1)
+	assert.Equal(t, publish.SpanContext().SpanID(), process.Links()[0].SpanContext.SpanID())
+}
+
+func TestTracerRunError(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	rec := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+
+	tracer := NewTracer(WithTracerProvider(tp))
+
+	rdOpt := &redis.ClusterOptions{Addrs: []string{s.Addr()}}
+
+	p, err := ami.NewProducer(ami.ProducerOptions{
+		Name:        "failed",
+		ShardsCount: 1,
+	}, rdOpt)
+	assert.NoError(t, err, "must not be an error")
+
+	p.Send("1")
+	p.Close()
+
+	c, err := ami.NewConsumer(ami.ConsumerOptions{
+		Block:       time.Millisecond * 100,
+		Name:        "failed",
+		ShardsCount: 1,
+		Tracer:      tracer,
+	}, rdOpt)
+	assert.NoError(t, err, "must not be an error")
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	c.Run(ctx, func(ctx context.Context, m ami.Message) error {
+		cancel()
+		return errors.New("boom")
+	}, 1)
+
+	c.Close()
+
+	spans := rec.Ended()
+	if !assert.Len(t, spans, 1) {
+		return
+	}
+
+	assert.Equal(t, "failed process", spans[0].Name())
+	assert.Equal(t, codes.Error, spans[0].Status().Code)
+	assert.Equal(t, "boom", spans[0].Status().Description)
+}
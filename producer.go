@@ -1,15 +1,28 @@
 package ami
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-redis/redis/v7"
 	"github.com/imdario/mergo"
-	"github.com/ssgreg/repeat"
 )
 
+// ErrOverflow is the error of message, that is dropped, because send buffer of
+// producer is full.
+var ErrOverflow = errors.New("Send buffer of producer is full")
+
+var errCloseTimeout = errors.New("Timeout of stopping of sending to Redis")
+
+// Time to wait for sending goroutines after cancelling of sending in
+// CloseContext
+const closeTimeout = time.Second * 10
+
 // NewProducer creates new producer client for Ami
 //
 // Note, that you MUST set in ClusterOptions ReadTimeout and WriteTimeout to at
@@ -22,33 +35,88 @@ import (
 // big messages. And not so strictly for Consumer, because it send big queries
 // with not so big messages (only ids of ACKed messages).
 func NewProducer(opt ProducerOptions, ropt *redis.ClusterOptions) (*Producer, error) {
+	return newProducer(opt, clientOptions{ropt: ropt})
+}
+
+// NewProducerWithClient creates new producer client for Ami with externally
+// supplied Redis client.
+//
+// Any redis.UniversalClient can be used: redis.Client for standalone Redis,
+// failover redis.Client for Redis Sentinel or redis.ClusterClient for Redis
+// Cluster. Shards of queue are placed by hash tags, so same queue can be used
+// with any of them.
+// Client is used as is, so ReadTimeout and WriteTimeout notes of NewProducer
+// are applicable to it too. Client is not closed by Ami.
+func NewProducerWithClient(opt ProducerOptions, rDB redis.UniversalClient) (*Producer, error) {
+	return newProducer(opt, clientOptions{rDB: rDB})
+}
+
+func newProducer(opt ProducerOptions, copt clientOptions) (*Producer, error) {
 	if err := mergo.Merge(&opt, defaultProducerOptions); err != nil {
 		return nil, err
 	}
 
-	client, err := newClient(clientOptions{
-		name:        opt.Name,
-		ropt:        ropt,
-		shardsCount: opt.ShardsCount,
-	})
+	if len(opt.Groups) == 0 {
+		opt.Groups = []string{defaultGroup(opt.Name)}
+	}
+
+	copt.groups = opt.Groups
+	copt.name = opt.Name
+	copt.startID = opt.GroupStartID
+	copt.shardsCount = opt.ShardsCount
+
+	client, err := newClient(copt)
 	if err != nil {
 		return nil, err
 	}
 
-	c := make(chan string, opt.PendingBufferSize)
+	c := make(chan toSend, opt.PendingBufferSize)
+
+	ctx, cancel := context.WithCancel(context.Background())
 
 	pr := &Producer{
-		c:     c,
-		cl:    client,
-		notif: opt.ErrorNotifier,
-		opt:   opt,
-		wg:    &sync.WaitGroup{},
+		c:       c,
+		cancel:  cancel,
+		cl:      client,
+		ctx:     ctx,
+		metr:    opt.MetricsNotifier,
+		notif:   opt.ErrorNotifier,
+		opt:     opt,
+		ordered: make([]chan struct{}, opt.ShardsCount),
+		wg:      &sync.WaitGroup{},
+		wgBg:    &sync.WaitGroup{},
+	}
+
+	if opt.MaxInFlightPipelines > 0 {
+		pr.inFlight = make(chan struct{}, opt.MaxInFlightPipelines)
+	}
+
+	if opt.MaxPendingBytes > 0 {
+		pr.pending = newBytesLimit(opt.MaxPendingBytes)
+	}
+
+	if opt.SpoolDir != "" {
+		pr.spool, err = newSpool(opt.SpoolDir, opt.Name, opt.SpoolSync, opt.SpoolSegmentSize)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
 	}
 
 	pr.wg.Add(1)
 
 	go pr.produce()
 
+	if pr.spool != nil {
+		pr.wgBg.Add(1)
+		go pr.replaySpool()
+	}
+
+	if opt.MaxLen > 0 || opt.Retention > 0 {
+		pr.wgBg.Add(1)
+		go pr.trim()
+	}
+
 	return pr, nil
 }
 
@@ -57,66 +125,452 @@ func NewProducer(opt ProducerOptions, ropt *redis.ClusterOptions) (*Producer, er
 // Function locks until all produced messages will be sent to Redis.
 // If PendingBufferSize has huge value - Close can wait long time.
 func (p *Producer) Close() {
+	_ = p.CloseContext(context.Background())
+}
+
+// CloseContext closes queue client.
+//
+// Function locks until all produced messages will be sent to Redis or context
+// is done.
+// If context is done before - sending is cancelled and context error is
+// returned. Not sent messages are lost, or are written to spool, if SpoolDir
+// is set. Function waits up to closeTimeout after cancelling for writing to
+// spool.
+func (p *Producer) CloseContext(ctx context.Context) error {
 	close(p.c)
-	p.wg.Wait()
+
+	done := make(chan struct{})
+
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	var err error
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	p.cancel()
+
+	// Cancelled batches and background goroutines finish without waiting for
+	// Redis, but they may be in the middle of request to it
+	bgDone := make(chan struct{})
+
+	go func() {
+		<-done
+		p.wgBg.Wait()
+		close(bgDone)
+	}()
+
+	select {
+	case <-bgDone:
+	case <-time.After(closeTimeout):
+		if err == nil {
+			err = errCloseTimeout
+		}
+
+		return err
+	}
+
+	if p.spool != nil {
+		if spErr := p.spool.close(); spErr != nil && err == nil {
+			err = spErr
+		}
+	}
+
+	return err
 }
 
 // Send message.
 //
 // Message not sended immediately, but pushed to send buffer and sended to Redis
 // in other goroutine.
+// If send buffer is full - Send acts by OverflowPolicy. By default it locks
+// until there will be free space in buffer.
 func (p *Producer) Send(m string) {
-	p.c <- m
+	_ = p.push(context.Background(), toSend{body: m})
+}
+
+// SendBytes sends binary message.
+//
+// Same as Send, but without conversion of message to string. Message is sent
+// to Redis as is, without copying, so don't modify slice after SendBytes.
+func (p *Producer) SendBytes(m []byte) {
+	_ = p.push(context.Background(), toSend{extra: &toSendExtra{bytes: m}})
+}
+
+// SendWithKey sends message with key.
+//
+// All messages with same key are sent to same shard, selected by hash of key,
+// and are added to it in order of sending. So messages with same key are
+// got by consumer in FIFO order, if consumer processes them serially, for
+// example, in one goroutine, that reads consumer channel.
+// Nack and reclaiming of messages breaks this order.
+func (p *Producer) SendWithKey(key string, m string) {
+	_ = p.push(context.Background(), toSend{body: m, extra: &toSendExtra{keyed: true, shard: keyShard(key, p.opt.ShardsCount)}})
+}
+
+// SendMessage sends message with headers.
+//
+// Only Body and Headers of message are used.
+// Same as Send, message not sended immediately.
+func (p *Producer) SendMessage(m Message) {
+	_ = p.push(m.Context(), toSend{body: m.Body, extra: &toSendExtra{headers: m.Headers}})
+}
+
+// SendAsync sends message and returns Future, that is resolved with ID of
+// message in Redis stream, when message is sent.
+//
+// Same as Send, message not sended immediately. If message is dropped by
+// OverflowPolicy - Future is resolved with ErrOverflow.
+func (p *Producer) SendAsync(m string) *Future {
+	f := newFuture()
+	_ = p.push(context.Background(), toSend{body: m, extra: &toSendExtra{result: f}})
+
+	return f
+}
+
+// SendSync sends message and locks until it is sent to Redis or context is
+// done. Returns ID of message in Redis stream.
+//
+// Message is sent in same batch with other messages, so it may wait up to
+// PipePeriod. If context is done, when message is already in send buffer -
+// message may be sent later.
+// If message is dropped by OverflowPolicy - ErrOverflow is returned.
+func (p *Producer) SendSync(ctx context.Context, m string) (string, error) {
+	f := newFuture()
+
+	if err := p.push(ctx, toSend{body: m, extra: &toSendExtra{result: f}}); err != nil {
+		return "", err
+	}
+
+	return f.Wait(ctx)
+}
+
+// SendContext sends message.
+//
+// Same as Send, but if send buffer is full and context is done before there
+// will be free space in buffer - message is not sent and context error is
+// returned.
+// If message is dropped by OverflowPolicy - ErrOverflow is returned.
+func (p *Producer) SendContext(ctx context.Context, m string) error {
+	return p.push(ctx, toSend{body: m})
+}
+
+// SendAt sends message, that will be got by consumers at time.
+//
+// Unlike Send, message is sent to Redis immediately, bypassing send buffer, to
+// sorted set of delayed messages "qu{N}_<name>_delayed" of one of shards.
+// Started consumers of queue move due messages to queue stream every
+// DelayPeriod, so message is got with up to DelayPeriod lag. Message with time
+// in the past is moved at next moving.
+func (p *Producer) SendAt(m string, at time.Time) error {
+	shard := int(atomic.AddUint32(&p.delayed, 1) % uint32(p.opt.ShardsCount))
+
+	return p.cl.addDelayed(shard, map[string]interface{}{"m": m}, at)
+}
+
+// SendAfter sends message, that will be got by consumers after delay.
+//
+// Same as SendAt.
+func (p *Producer) SendAfter(m string, delay time.Duration) error {
+	return p.SendAt(m, time.Now().Add(delay))
+}
+
+// TrySend sends message, if there is free space in send buffer.
+//
+// TrySend never locks and ignores OverflowPolicy. Returns false, if send
+// buffer is full and message is not sent.
+func (p *Producer) TrySend(m string) bool {
+	msg := p.trace(context.Background(), toSend{body: m})
+
+	if p.tryPush(msg) {
+		return true
+	}
+
+	p.finish(msg, ErrOverflow)
+
+	return false
+}
+
+// push pushes message to send buffer by OverflowPolicy.
+// Returns ErrOverflow, if message is dropped, or context error.
+func (p *Producer) push(ctx context.Context, m toSend) error {
+	m = p.trace(ctx, m)
+
+	if p.tryPush(m) {
+		return nil
+	}
+
+	var err error
+
+	switch p.opt.OverflowPolicy {
+	case OverflowBlock, OverflowBlockWithTimeout:
+		var timeout <-chan time.Time
+
+		if p.opt.OverflowPolicy == OverflowBlockWithTimeout {
+			timer := time.NewTimer(p.opt.OverflowTimeout)
+			defer timer.Stop()
+
+			timeout = timer.C
+		}
+
+		err = p.waitPush(ctx, timeout, m)
+		if err == nil {
+			return nil
+		} else if err != ErrOverflow {
+			p.finish(m, err)
+			return err
+		}
+	case OverflowDropOldest:
+		for {
+			select {
+			case old := <-p.c:
+				if p.pending != nil {
+					p.pending.release(old.size())
+				}
+
+				p.drop(old)
+			default:
+			}
+
+			if p.tryPush(m) {
+				return nil
+			}
+		}
+	default:
+		err = ErrOverflow
+	}
+
+	p.drop(m)
+
+	if p.opt.OverflowPolicy == OverflowReturnError && p.notif != nil {
+		p.notif.AmiError(err)
+	}
+
+	return err
+}
+
+// tryPush pushes message to send buffer, if there is free space in it.
+func (p *Producer) tryPush(m toSend) bool {
+	if p.pending != nil {
+		if ok, _ := p.pending.tryAcquire(m.size()); !ok {
+			return false
+		}
+	}
+
+	select {
+	case p.c <- m:
+		return true
+	default:
+		if p.pending != nil {
+			p.pending.release(m.size())
+		}
+
+		return false
+	}
+}
+
+// waitPush pushes message to send buffer, waiting for free space in it.
+// Returns context error or ErrOverflow on timeout, if message is not pushed.
+func (p *Producer) waitPush(ctx context.Context, timeout <-chan time.Time, m toSend) error {
+	if p.pending != nil {
+		for {
+			ok, freed := p.pending.tryAcquire(m.size())
+			if ok {
+				break
+			}
+
+			select {
+			case <-freed:
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-timeout:
+				return ErrOverflow
+			}
+		}
+	}
+
+	var err error
+
+	select {
+	case p.c <- m:
+		return nil
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-timeout:
+		err = ErrOverflow
+	}
+
+	if p.pending != nil {
+		p.pending.release(m.size())
+	}
+
+	return err
+}
+
+// drop drops message by OverflowPolicy.
+func (p *Producer) drop(m toSend) {
+	p.finish(m, ErrOverflow)
+
+	if p.opt.FailNotifier != nil {
+		msg := Message{Body: m.body}
+
+		if m.extra != nil {
+			msg.Headers = m.extra.headers
+
+			if m.extra.bytes != nil {
+				msg.Body = string(m.extra.bytes)
+			}
+
+			if m.extra.keyed {
+				msg.Stream = fmt.Sprintf("qu{%d}_%s", m.extra.shard, p.opt.Name)
+			}
+		}
+
+		p.opt.FailNotifier.AmiFailed("overflow", []Message{msg}, ErrOverflow)
+	}
+}
+
+// finish resolves future and finishes trace of not sent message.
+func (p *Producer) finish(m toSend, err error) {
+	if m.extra == nil {
+		return
+	}
+
+	if m.extra.result != nil {
+		m.extra.result.resolve("", err)
+	}
+
+	if m.extra.traced != nil {
+		m.extra.traced("", err)
+	}
+}
+
+// trace starts tracing of message, if Tracer is set.
+// Headers are copied, because Tracer adds propagation data to them.
+func (p *Producer) trace(ctx context.Context, m toSend) toSend {
+	if p.opt.Tracer == nil {
+		return m
+	}
+
+	extra := toSendExtra{}
+	if m.extra != nil {
+		extra = *m.extra
+	}
+
+	headers := make(map[string]string, len(extra.headers)+2)
+	for k, v := range extra.headers {
+		headers[k] = v
+	}
+
+	extra.headers = headers
+	extra.traced = p.opt.Tracer.AmiSend(ctx, p.opt.Name, headers)
+	m.extra = &extra
+
+	return m
 }
 
 func (p *Producer) produce() {
 	shard := 0
 
-	buf := make([]string, p.opt.PipeBufferSize)
-	idx := 0
+	// Buffers are allocated at first usage, because messages with keys may
+	// be not used at all
+	bufs := make([][]toSend, p.opt.ShardsCount)
+	sizes := make([]int64, p.opt.ShardsCount)
 
 	started := time.Now()
 	tick := time.NewTicker(p.opt.PipePeriod)
 
+	var metrTick <-chan time.Time
+
+	if p.metr != nil {
+		t := time.NewTicker(bufferMetricPeriod)
+		defer t.Stop()
+
+		metrTick = t.C
+	}
+
 	for {
 		var doStop bool
 
+		full := -1
+
 		select {
 		case m, more := <-p.c:
 			if !more {
 				doStop = true
 			} else {
-				buf[idx] = m
-				idx++
+				to := shard
+				if m.extra != nil && m.extra.keyed {
+					to = int(m.extra.shard)
+				}
+
+				if bufs[to] == nil {
+					bufs[to] = make([]toSend, 0, p.opt.PipeBufferSize)
+				}
+
+				var size int64
+				if p.pending != nil || p.opt.MaxPipeBytes > 0 {
+					size = m.size()
+				}
+
+				if p.pending != nil {
+					p.pending.release(size)
+				}
+
+				// Send collected batch before it will exceed limit of size
+				if p.opt.MaxPipeBytes > 0 && len(bufs[to]) > 0 && sizes[to]+size > p.opt.MaxPipeBytes {
+					p.sendWithLock(to, bufs[to])
+					bufs[to] = bufs[to][:0]
+					sizes[to] = 0
+				}
+
+				bufs[to] = append(bufs[to], m)
+				sizes[to] += size
+
+				if len(bufs[to]) == int(p.opt.PipeBufferSize) || (p.opt.MaxPipeBytes > 0 && sizes[to] >= p.opt.MaxPipeBytes) {
+					full = to
+				}
 			}
 		case <-tick.C:
+		case <-metrTick:
+			p.metr.AmiBuffer(p.opt.Name, "pending", len(p.c), cap(p.c))
 		}
 
 		if doStop {
-			p.sendWithLock(shard, buf[0:idx])
+			for i := range bufs {
+				p.sendWithLock(i, bufs[i])
+			}
+
 			break
 		}
 
-		var doSend bool
-
 		switch {
-		case idx == int(p.opt.PipeBufferSize):
-			doSend = true
+		case full != -1:
+			p.sendWithLock(full, bufs[full])
+			bufs[full] = bufs[full][:0]
+			sizes[full] = 0
+
+			if full != shard {
+				continue
+			}
 		case time.Since(started) >= p.opt.PipePeriod && len(p.c) == 0:
 			// Don't send by time if there are more messages in channel
 			// Prefer to collect them in batch to speedup producing
-			doSend = true
+			for i := range bufs {
+				p.sendWithLock(i, bufs[i])
+				bufs[i] = bufs[i][:0]
+				sizes[i] = 0
+			}
 		default:
-			doSend = false
-		}
-
-		if !doSend {
 			continue
 		}
 
-		p.sendWithLock(shard, buf[0:idx])
-
-		idx = 0
 		started = time.Now()
 
 		shard++
@@ -128,7 +582,7 @@ func (p *Producer) produce() {
 	p.wg.Done()
 }
 
-func (p *Producer) sendWithLock(shard int, buf []string) {
+func (p *Producer) sendWithLock(shard int, buf []toSend) {
 	if len(buf) == 0 {
 		return
 	}
@@ -137,47 +591,199 @@ func (p *Producer) sendWithLock(shard int, buf []string) {
 
 	stream := fmt.Sprintf("qu{%d}_%s", shard, p.opt.Name)
 
+	var (
+		keyed   bool
+		results []*Future
+		traced  []func(string, error)
+	)
+
 	for i, m := range buf {
 		args[i] = redis.XAddArgs{
-			ID:     "*",
-			Stream: stream,
-			Values: map[string]interface{}{"m": m},
+			ID:           "*",
+			MaxLenApprox: p.opt.MaxLen,
+			Stream:       stream,
+			Values:       map[string]interface{}{"m": m.body},
+		}
+
+		if m.extra == nil {
+			continue
+		}
+
+		if m.extra.bytes != nil {
+			args[i].Values["m"] = m.extra.bytes
+		}
+
+		setHeaders(args[i].Values, m.extra.headers)
+
+		keyed = keyed || m.extra.keyed
+
+		if m.extra.result != nil {
+			if results == nil {
+				results = make([]*Future, len(buf))
+			}
+
+			results[i] = m.extra.result
+		}
+
+		if m.extra.traced != nil {
+			if traced == nil {
+				traced = make([]func(string, error), len(buf))
+			}
+
+			traced[i] = m.extra.traced
+		}
+	}
+
+	// Batches with keys are sent one by one to keep order of messages with
+	// same key
+	var prev, done chan struct{}
+
+	if keyed {
+		prev = p.ordered[shard]
+		done = make(chan struct{})
+		p.ordered[shard] = done
+	}
+
+	if p.inFlight != nil {
+		started := time.Now()
+
+		p.inFlight <- struct{}{}
+
+		if p.metr != nil {
+			p.metr.AmiInFlightWait(p.opt.Name, "send", time.Since(started))
 		}
 	}
 
 	p.wg.Add(1)
 
+	if p.metr != nil {
+		p.metr.AmiInFlight(p.opt.Name, "send", 1)
+	}
+
 	go func() {
-		p.send(args)
+		if prev != nil {
+			<-prev
+		}
+
+		p.send(shard, args, results, traced)
+
+		if done != nil {
+			close(done)
+		}
+
+		if p.metr != nil {
+			p.metr.AmiInFlight(p.opt.Name, "send", -1)
+		}
+
+		if p.inFlight != nil {
+			<-p.inFlight
+		}
+
 		p.wg.Done()
 	}()
 }
 
-func (p *Producer) send(args []redis.XAddArgs) {
-	err := repeat.Repeat(
-		repeat.Fn(func() error {
-			pipe := p.cl.rDB.TxPipeline()
+// send sends batch of messages and resolves futures and finishes traces of
+// messages, if they are set.
+func (p *Producer) send(shard int, args []redis.XAddArgs, results []*Future, traced []func(string, error)) {
+	var cmds []*redis.StringCmd
 
-			for _, m := range args {
-				pipe.XAdd(&m)
-			}
+	started := time.Now()
 
-			_, err := pipe.Exec()
-			if err != nil {
-				if p.notif != nil {
-					p.notif.AmiError(err)
-				}
+	err := p.opt.RetryPolicy.retry(p.ctx, func() error {
+		pipe := p.cl.rDB.TxPipeline()
 
-				return repeat.HintTemporary(err)
-			}
+		cmds = make([]*redis.StringCmd, len(args))
 
-			return nil
-		}),
-		repeat.StopOnSuccess(),
-		repeat.WithDelay(repeat.FullJitterBackoff(500*time.Millisecond).Set()),
-	)
+		for i := range args {
+			cmds[i] = pipe.XAdd(&args[i])
+		}
+
+		_, err := pipe.Exec()
+
+		return err
+	}, func(err error) {
+		if p.notif != nil {
+			p.notif.AmiError(err)
+		}
+
+		if p.metr != nil {
+			p.metr.AmiRetry(p.opt.Name, shard, "send", err)
+		}
+	})
 
 	if err != nil && p.notif != nil {
 		p.notif.AmiError(err)
 	}
+
+	if err != nil && p.spool != nil {
+		if spErr := p.spool.write(args); spErr != nil {
+			if p.notif != nil {
+				p.notif.AmiError(spErr)
+			}
+		} else {
+			err = ErrSpooled
+		}
+	}
+
+	if err != nil && err != ErrSpooled && p.opt.FailNotifier != nil {
+		p.opt.FailNotifier.AmiFailed("send", failedMessages(args), err)
+	}
+
+	if p.metr != nil {
+		p.metr.AmiPipeline(p.opt.Name, shard, "send", len(args), time.Since(started), err)
+	}
+
+	for i, f := range results {
+		if f == nil {
+			continue
+		}
+
+		if err != nil {
+			f.resolve("", err)
+		} else {
+			f.resolve(cmds[i].Val(), nil)
+		}
+	}
+
+	for i, fn := range traced {
+		if fn == nil {
+			continue
+		}
+
+		if err != nil {
+			fn("", err)
+		} else {
+			fn(cmds[i].Val(), nil)
+		}
+	}
+}
+
+// failedMessages converts not sent batch to messages for FailNotifier.
+func failedMessages(args []redis.XAddArgs) []Message {
+	msgs := make([]Message, len(args))
+
+	for i, a := range args {
+		msgs[i] = Message{
+			Headers: parseHeaders(a.Values),
+			Stream:  a.Stream,
+		}
+
+		switch body := a.Values["m"].(type) {
+		case string:
+			msgs[i].Body = body
+		case []byte:
+			msgs[i].Body = string(body)
+		}
+	}
+
+	return msgs
+}
+
+// keyShard returns shard for key by FNV-1a hash of it.
+func keyShard(key string, shardsCount int8) int32 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+
+	return int32(h.Sum32() % uint32(shardsCount))
 }
@@ -1,7 +1,13 @@
 package ami
 
 import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
+	"unsafe"
 
 	"github.com/alicebob/miniredis/v2"
 	"github.com/go-redis/redis/v7"
@@ -24,3 +30,490 @@ func TestNewProducer(t *testing.T) {
 
 	p.Close()
 }
+
+func TestProducerContext(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	rdOpt := &redis.ClusterOptions{Addrs: []string{s.Addr()}}
+
+	p, err := NewProducer(ProducerOptions{}, rdOpt)
+	assert.NoError(t, err, "must not be an error")
+
+	err = p.SendContext(context.Background(), "ok")
+	assert.NoError(t, err, "must not be an error")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	err = p.CloseContext(ctx)
+	assert.NoError(t, err, "must not be an error")
+}
+
+func TestSendBytes(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	rdOpt := &redis.ClusterOptions{Addrs: []string{s.Addr()}}
+
+	c, err := NewConsumer(ConsumerOptions{Block: time.Millisecond * 100}, rdOpt)
+	assert.NoError(t, err, "must not be an error")
+
+	p, err := NewProducer(ProducerOptions{}, rdOpt)
+	assert.NoError(t, err, "must not be an error")
+
+	body := []byte{0, 1, 0xff, 0xfe, 'o', 'k'}
+
+	p.SendBytes(body)
+	p.Close()
+
+	ch := c.Start()
+
+	select {
+	case msg := <-ch:
+		assert.Equal(t, body, msg.Bytes(), "Got unexpected message")
+		c.Ack(msg)
+	case <-time.After(time.Second):
+		assert.FailNow(t, "must not wait for a long time")
+	}
+
+	c.Stop()
+	c.Close()
+}
+
+func TestSendWithKey(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	// Cluster client splits pipe with miniredis, because miniredis don't
+	// return key positions of stream commands
+	rDB := redis.NewClient(&redis.Options{Addr: s.Addr()})
+	defer rDB.Close()
+
+	p, err := NewProducerWithClient(ProducerOptions{Name: "key", PipeBufferSize: 2}, rDB)
+	assert.NoError(t, err, "must not be an error")
+
+	for i := 0; i < 10; i++ {
+		p.SendWithKey("customer", strconv.Itoa(i))
+		p.Send("other")
+	}
+
+	p.Close()
+
+	stream := fmt.Sprintf("qu{%d}_key", keyShard("customer", 10))
+
+	res, err := p.cl.rDB.XRange(stream, "-", "+").Result()
+	assert.NoError(t, err, "must not be an error")
+
+	var got []string
+
+	for _, m := range res {
+		if m.Values["m"] != "other" {
+			got = append(got, m.Values["m"].(string))
+		}
+	}
+
+	assert.Equal(t, []string{"0", "1", "2", "3", "4", "5", "6", "7", "8", "9"}, got)
+}
+
+func TestSendSync(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	rdOpt := &redis.ClusterOptions{Addrs: []string{s.Addr()}}
+
+	p, err := NewProducer(ProducerOptions{Name: "sync", ShardsCount: 1}, rdOpt)
+	assert.NoError(t, err, "must not be an error")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	id, err := p.SendSync(ctx, "sync")
+	assert.NoError(t, err, "must not be an error")
+
+	f := p.SendAsync("async")
+
+	asyncID, err := f.Wait(ctx)
+	assert.NoError(t, err, "must not be an error")
+
+	res, err := p.cl.rDB.XRange("qu{0}_sync", "-", "+").Result()
+	assert.NoError(t, err, "must not be an error")
+	assert.Len(t, res, 2)
+	assert.Equal(t, id, res[0].ID)
+	assert.Equal(t, asyncID, res[1].ID)
+
+	p.Close()
+}
+
+func TestMaxInFlightPipelines(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	rDB := redis.NewClient(&redis.Options{Addr: s.Addr()})
+	defer rDB.Close()
+
+	hook := &pipeHook{cmd: "xadd"}
+	rDB.AddHook(hook)
+
+	p, err := NewProducerWithClient(ProducerOptions{
+		MaxInFlightPipelines: 1,
+		Name:                 "inflight",
+		PipeBufferSize:       1,
+		ShardsCount:          2,
+	}, rDB)
+	assert.NoError(t, err, "must not be an error")
+
+	for i := 0; i < 100; i++ {
+		p.Send("1")
+	}
+
+	p.Close()
+
+	assert.Len(t, p.inFlight, 0)
+	assert.Equal(t, 100, hook.total)
+	assert.Equal(t, 1, hook.max)
+
+	for i := 0; i < 2; i++ {
+		cnt, err := p.cl.rDB.XLen(fmt.Sprintf("qu{%d}_inflight", i)).Result()
+		assert.NoError(t, err, "must not be an error")
+		assert.Equal(t, int64(50), cnt)
+	}
+}
+
+func TestToSendSize(t *testing.T) {
+	// Send buffer takes PendingBufferSize slots, so slot must stay small
+	assert.LessOrEqual(t, int(unsafe.Sizeof(toSend{})), 24)
+}
+
+func TestOverflowPolicy(t *testing.T) {
+	fail := &overflowNotifier{C: make(chan []Message, 10)}
+
+	// Producer without produce goroutine, so send buffer is not read
+	newFull := func(policy OverflowPolicy) *Producer {
+		p := &Producer{
+			c: make(chan toSend, 1),
+			opt: ProducerOptions{
+				FailNotifier:    fail,
+				Name:            "overflow",
+				OverflowPolicy:  policy,
+				OverflowTimeout: time.Millisecond * 10,
+			},
+		}
+
+		p.Send("old")
+
+		return p
+	}
+
+	p := newFull(OverflowDropNewest)
+	assert.False(t, p.TrySend("new"))
+	p.Send("new")
+	assert.Equal(t, ErrOverflow, p.SendContext(context.Background(), "new"))
+	assert.Len(t, fail.C, 2)
+	assert.Equal(t, "old", (<-p.c).body)
+
+	f := newFull(OverflowDropNewest).SendAsync("new")
+	_, err := f.Result()
+	assert.Equal(t, ErrOverflow, err)
+
+	for len(fail.C) > 0 {
+		<-fail.C
+	}
+
+	p = newFull(OverflowDropOldest)
+	assert.NoError(t, p.SendContext(context.Background(), "new"), "must not be an error")
+	assert.Equal(t, "new", (<-p.c).body)
+	assert.Equal(t, "old", (<-fail.C)[0].Body)
+
+	p = newFull(OverflowReturnError)
+	assert.Equal(t, ErrOverflow, p.SendContext(context.Background(), "new"))
+
+	_, err = p.SendSync(context.Background(), "new")
+	assert.Equal(t, ErrOverflow, err)
+
+	p = newFull(OverflowBlockWithTimeout)
+	assert.Equal(t, ErrOverflow, p.SendContext(context.Background(), "new"))
+
+	p = newFull(OverflowBlock)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+
+	assert.Equal(t, context.DeadlineExceeded, p.SendContext(ctx, "new"))
+	assert.False(t, p.TrySend("new"))
+
+	assert.Len(t, fail.C, 3)
+	assert.Equal(t, "new", (<-fail.C)[0].Body)
+}
+
+func TestMaxPipeBytes(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	rdOpt := &redis.ClusterOptions{Addrs: []string{s.Addr()}}
+
+	p, err := NewProducer(ProducerOptions{
+		MaxPipeBytes:   10,
+		Name:           "pipebytes",
+		PipeBufferSize: 100,
+		PipePeriod:     time.Minute,
+		ShardsCount:    1,
+	}, rdOpt)
+	assert.NoError(t, err, "must not be an error")
+
+	p.Send("12345")
+	p.Send("12345")
+	p.Send("12345")
+
+	// Batch is sent by size before PipeBufferSize or PipePeriod is reached
+	assert.Eventually(t, func() bool {
+		cnt, err := p.cl.rDB.XLen("qu{0}_pipebytes").Result()
+		return err == nil && cnt == 2
+	}, time.Second, time.Millisecond*10)
+
+	p.Send("12345678901")
+	p.Close()
+
+	cnt, err := p.cl.rDB.XLen("qu{0}_pipebytes").Result()
+	assert.NoError(t, err, "must not be an error")
+	assert.Equal(t, int64(4), cnt)
+}
+
+func TestMaxPendingBytes(t *testing.T) {
+	// Producer without produce goroutine, so send buffer is not read
+	p := &Producer{
+		c: make(chan toSend, 10),
+		opt: ProducerOptions{
+			Name:            "pendingbytes",
+			OverflowPolicy:  OverflowBlockWithTimeout,
+			OverflowTimeout: time.Millisecond * 10,
+		},
+		pending: newBytesLimit(10),
+	}
+
+	assert.True(t, p.TrySend("12345"))
+	assert.True(t, p.TrySend("12345"))
+	assert.False(t, p.TrySend("1"))
+	assert.Equal(t, ErrOverflow, p.SendContext(context.Background(), "1"))
+
+	done := make(chan error)
+
+	p.opt.OverflowPolicy = OverflowBlock
+
+	go func() {
+		done <- p.SendContext(context.Background(), "12345")
+	}()
+
+	// Free space as produce goroutine does
+	m := <-p.c
+	p.pending.release(m.size())
+
+	select {
+	case err := <-done:
+		assert.NoError(t, err, "must not be an error")
+	case <-time.After(time.Second):
+		assert.FailNow(t, "must not wait for a long time")
+	}
+
+	assert.Len(t, p.c, 2)
+
+	// Message bigger than limit is accepted to empty buffer
+	for len(p.c) > 0 {
+		m := <-p.c
+		p.pending.release(m.size())
+	}
+
+	assert.True(t, p.TrySend("12345678901"))
+	assert.False(t, p.TrySend("1"))
+}
+
+func TestSendAt(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	rdOpt := &redis.ClusterOptions{Addrs: []string{s.Addr()}}
+
+	p, err := NewProducer(ProducerOptions{
+		Name:        "delayed",
+		ShardsCount: 2,
+	}, rdOpt)
+	assert.NoError(t, err, "must not be an error")
+
+	sent := time.Now()
+
+	assert.NoError(t, p.SendAt("past", time.Now().Add(-time.Second)), "must not be an error")
+	assert.NoError(t, p.SendAfter("later", time.Millisecond*300), "must not be an error")
+	assert.NoError(t, p.SendAfter("never", time.Hour), "must not be an error")
+
+	p.Close()
+
+	c, err := NewConsumer(ConsumerOptions{
+		Block:       time.Millisecond * 100,
+		DelayPeriod: time.Millisecond * 10,
+		Name:        "delayed",
+		ShardsCount: 2,
+	}, rdOpt)
+	assert.NoError(t, err, "must not be an error")
+
+	ch := c.Start()
+
+	var got []string
+
+	for i := 0; i < 2; i++ {
+		select {
+		case m := <-ch:
+			// Time of delayed message is stored in milliseconds
+			if m.Body == "later" {
+				assert.True(t, time.Since(sent) >= time.Millisecond*299, "must be delayed")
+			}
+
+			got = append(got, m.Body)
+			c.Ack(m)
+		case <-time.After(time.Second * 3):
+			assert.FailNow(t, "must not wait for a long time")
+		}
+	}
+
+	assert.ElementsMatch(t, []string{"past", "later"}, got)
+
+	c.Stop()
+	c.Close()
+
+	cnt := p.cl.rDB.ZCard("qu{0}_delayed_delayed").Val() + p.cl.rDB.ZCard("qu{1}_delayed_delayed").Val()
+	assert.Equal(t, int64(1), cnt)
+}
+
+func TestSendAtBytes(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	rdOpt := &redis.ClusterOptions{Addrs: []string{s.Addr()}}
+
+	p, err := NewProducer(ProducerOptions{
+		Name:        "delayedbytes",
+		ShardsCount: 1,
+	}, rdOpt)
+	assert.NoError(t, err, "must not be an error")
+
+	body := []byte{0, 0xff, 0xfe, ','}
+
+	assert.NoError(t, p.SendAfter(string(body), time.Millisecond*50), "must not be an error")
+
+	p.Close()
+
+	c, err := NewConsumer(ConsumerOptions{
+		Block:       time.Millisecond * 100,
+		DelayPeriod: time.Millisecond * 10,
+		Name:        "delayedbytes",
+		ShardsCount: 1,
+	}, rdOpt)
+	assert.NoError(t, err, "must not be an error")
+
+	ch := c.Start()
+
+	select {
+	case m := <-ch:
+		assert.Equal(t, body, m.Bytes())
+		c.Ack(m)
+	case <-time.After(time.Second * 3):
+		assert.FailNow(t, "must not wait for a long time")
+	}
+
+	c.Stop()
+	c.Close()
+}
+
+type overflowNotifier struct {
+	C chan []Message
+}
+
+func (n *overflowNotifier) AmiFailed(op string, msgs []Message, err error) {
+	if op == "overflow" {
+		n.C <- msgs
+	}
+}
+
+// pipeHook counts concurrent pipelines with command and slows them down to
+// catch concurrent sending.
+type pipeHook struct {
+	cmd   string
+	cur   int
+	max   int
+	mu    sync.Mutex
+	total int
+}
+
+func (h *pipeHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	return ctx, nil
+}
+
+func (h *pipeHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	return nil
+}
+
+func (h *pipeHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	if !h.match(cmds) {
+		return ctx, nil
+	}
+
+	h.mu.Lock()
+
+	h.cur++
+	h.total++
+
+	if h.cur > h.max {
+		h.max = h.cur
+	}
+
+	h.mu.Unlock()
+
+	time.Sleep(time.Millisecond)
+
+	return ctx, nil
+}
+
+func (h *pipeHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	if !h.match(cmds) {
+		return nil
+	}
+
+	h.mu.Lock()
+	h.cur--
+	h.mu.Unlock()
+
+	return nil
+}
+
+func (h *pipeHook) match(cmds []redis.Cmder) bool {
+	for _, cmd := range cmds {
+		if cmd.Name() == h.cmd {
+			return true
+		}
+	}
+
+	return false
+}
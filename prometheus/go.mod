@@ -0,0 +1,14 @@
+module github.com/kak-tus/ami/prometheus
+
+go 1.13
+
+require (
+	github.com/alicebob/miniredis/v2 v2.23.1
+	github.com/go-redis/redis/v7 v7.2.0
+	github.com/kak-tus/ami v0.0.0
+	github.com/prometheus/client_golang v1.7.1
+	github.com/stretchr/testify v1.5.1
+)
+
+// Local version of Ami is used until root module is tagged
+replace github.com/kak-tus/ami => ../
@@ -0,0 +1,193 @@
+// Package prometheus provides Prometheus collector of Ami metrics.
+//
+// Collector implements ami.MetricsNotifier and prometheus.Collector, so it can
+// be set as MetricsNotifier in options of producers and consumers and
+// registered in Prometheus registry:
+//
+//	metrics := prometheus.NewCollector("myapp")
+//	prom.MustRegister(metrics)
+//
+//	pr, err := ami.NewProducer(ami.ProducerOptions{
+//		MetricsNotifier: metrics,
+//		...
+//	}, ropt)
+//
+// One collector can be used with any amount of producers and consumers.
+package prometheus
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/kak-tus/ami"
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+// Collector collects metrics of Ami producers and consumers.
+type Collector struct {
+	acked        *prom.CounterVec
+	bufCap       *prom.GaugeVec
+	bufLen       *prom.GaugeVec
+	batchSize    *prom.HistogramVec
+	consumed     *prom.CounterVec
+	duration     *prom.HistogramVec
+	failed       *prom.CounterVec
+	inFlight     *prom.GaugeVec
+	inFlightWait *prom.HistogramVec
+	retries      *prom.CounterVec
+	sent         *prom.CounterVec
+	collectors   []prom.Collector
+}
+
+var _ ami.MetricsNotifier = &Collector{}
+var _ prom.Collector = &Collector{}
+
+// NewCollector creates new collector with metrics in namespace.
+// Namespace may be empty.
+func NewCollector(namespace string) *Collector {
+	c := &Collector{
+		acked: prom.NewCounterVec(prom.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "ami",
+			Name:      "acked_messages_total",
+			Help:      "Amount of messages, ACKed in Redis by consumer.",
+		}, []string{"queue", "shard"}),
+		bufCap: prom.NewGaugeVec(prom.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "ami",
+			Name:      "buffer_capacity",
+			Help:      "Capacity of internal buffer.",
+		}, []string{"queue", "buffer"}),
+		bufLen: prom.NewGaugeVec(prom.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "ami",
+			Name:      "buffer_length",
+			Help:      "Amount of messages in internal buffer.",
+		}, []string{"queue", "buffer"}),
+		batchSize: prom.NewHistogramVec(prom.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "ami",
+			Name:      "pipeline_batch_size",
+			Help:      "Amount of messages in one pipeline.",
+			Buckets:   prom.ExponentialBuckets(1, 4, 9),
+		}, []string{"queue", "op"}),
+		consumed: prom.NewCounterVec(prom.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "ami",
+			Name:      "consumed_messages_total",
+			Help:      "Amount of messages, pushed to consumer channel.",
+		}, []string{"queue", "shard"}),
+		duration: prom.NewHistogramVec(prom.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "ami",
+			Name:      "pipeline_duration_seconds",
+			Help:      "Duration of pipeline with all retries.",
+			Buckets:   prom.ExponentialBuckets(0.0005, 4, 10),
+		}, []string{"queue", "op"}),
+		failed: prom.NewCounterVec(prom.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "ami",
+			Name:      "failed_messages_total",
+			Help:      "Amount of messages in failed pipelines.",
+		}, []string{"queue", "shard", "op"}),
+		inFlight: prom.NewGaugeVec(prom.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "ami",
+			Name:      "pipelines_in_flight",
+			Help:      "Amount of pipelines, that are sending to Redis.",
+		}, []string{"queue", "op"}),
+		inFlightWait: prom.NewHistogramVec(prom.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "ami",
+			Name:      "pipeline_wait_seconds",
+			Help:      "Duration of waiting of free slot for pipeline, if amount of pipelines is limited.",
+			Buckets:   prom.ExponentialBuckets(0.0005, 4, 10),
+		}, []string{"queue", "op"}),
+		retries: prom.NewCounterVec(prom.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "ami",
+			Name:      "retries_total",
+			Help:      "Amount of failed attempts of operations, that are retried.",
+		}, []string{"queue", "shard", "op"}),
+		sent: prom.NewCounterVec(prom.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "ami",
+			Name:      "sent_messages_total",
+			Help:      "Amount of messages, sent to Redis by producer.",
+		}, []string{"queue", "shard"}),
+	}
+
+	c.collectors = []prom.Collector{
+		c.acked,
+		c.bufCap,
+		c.bufLen,
+		c.batchSize,
+		c.consumed,
+		c.duration,
+		c.failed,
+		c.inFlight,
+		c.inFlightWait,
+		c.retries,
+		c.sent,
+	}
+
+	return c
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prom.Desc) {
+	for _, col := range c.collectors {
+		col.Describe(ch)
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prom.Metric) {
+	for _, col := range c.collectors {
+		col.Collect(ch)
+	}
+}
+
+// AmiBuffer implements ami.MetricsNotifier.
+func (c *Collector) AmiBuffer(queue string, buffer string, length int, capacity int) {
+	c.bufLen.WithLabelValues(queue, buffer).Set(float64(length))
+	c.bufCap.WithLabelValues(queue, buffer).Set(float64(capacity))
+}
+
+// AmiConsumed implements ami.MetricsNotifier.
+func (c *Collector) AmiConsumed(queue string, shard int, count int) {
+	c.consumed.WithLabelValues(queue, strconv.Itoa(shard)).Add(float64(count))
+}
+
+// AmiInFlight implements ami.MetricsNotifier.
+func (c *Collector) AmiInFlight(queue string, op string, delta int) {
+	c.inFlight.WithLabelValues(queue, op).Add(float64(delta))
+}
+
+// AmiInFlightWait implements ami.MetricsNotifier.
+func (c *Collector) AmiInFlightWait(queue string, op string, duration time.Duration) {
+	c.inFlightWait.WithLabelValues(queue, op).Observe(duration.Seconds())
+}
+
+// AmiPipeline implements ami.MetricsNotifier.
+func (c *Collector) AmiPipeline(queue string, shard int, op string, count int, duration time.Duration, err error) {
+	c.duration.WithLabelValues(queue, op).Observe(duration.Seconds())
+	c.batchSize.WithLabelValues(queue, op).Observe(float64(count))
+
+	if err != nil {
+		c.failed.WithLabelValues(queue, strconv.Itoa(shard), op).Add(float64(count))
+		return
+	}
+
+	switch op {
+	case "send":
+		c.sent.WithLabelValues(queue, strconv.Itoa(shard)).Add(float64(count))
+	case "ack":
+		c.acked.WithLabelValues(queue, strconv.Itoa(shard)).Add(float64(count))
+	}
+}
+
+// AmiRetry implements ami.MetricsNotifier.
+func (c *Collector) AmiRetry(queue string, shard int, op string, err error) {
+	c.retries.WithLabelValues(queue, strconv.Itoa(shard), op).Inc()
+}
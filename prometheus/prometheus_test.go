@@ -0,0 +1,85 @@
+package prometheus
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v7"
+	"github.com/kak-tus/ami"
+	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCollector(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	metrics := NewCollector("test")
+
+	reg := prom.NewRegistry()
+	assert.NoError(t, reg.Register(metrics), "must not be an error")
+
+	rdOpt := &redis.ClusterOptions{Addrs: []string{s.Addr()}}
+
+	c, err := ami.NewConsumer(ami.ConsumerOptions{
+		Block:                time.Millisecond * 100,
+		MaxInFlightPipelines: 1,
+		MetricsNotifier:      metrics,
+		Name:                 "metrics",
+		ShardsCount:          2,
+	}, rdOpt)
+	assert.NoError(t, err, "must not be an error")
+
+	p, err := ami.NewProducer(ami.ProducerOptions{
+		MaxInFlightPipelines: 1,
+		MetricsNotifier:      metrics,
+		Name:                 "metrics",
+		PendingBufferSize:    10,
+		PipeBufferSize:       1,
+		ShardsCount:          2,
+	}, rdOpt)
+	assert.NoError(t, err, "must not be an error")
+
+	p.Send("1")
+	p.Send("2")
+	p.Close()
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.sent.WithLabelValues("metrics", "0")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.sent.WithLabelValues("metrics", "1")))
+	assert.Equal(t, float64(0), testutil.ToFloat64(metrics.inFlight.WithLabelValues("metrics", "send")))
+
+	ch := c.Start()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case m := <-ch:
+			c.Ack(m)
+		case <-time.After(time.Second):
+			assert.FailNow(t, "must not wait for a long time")
+		}
+	}
+
+	c.Stop()
+	c.Close()
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.consumed.WithLabelValues("metrics", "0")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.consumed.WithLabelValues("metrics", "1")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.acked.WithLabelValues("metrics", "0")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.acked.WithLabelValues("metrics", "1")))
+
+	assert.Equal(t, 2, testutil.CollectAndCount(metrics.duration))
+	assert.Equal(t, 0, testutil.CollectAndCount(metrics.failed))
+	assert.Equal(t, 2, testutil.CollectAndCount(metrics.inFlightWait))
+
+	metrics.AmiBuffer("metrics", "pending", 5, 10)
+	assert.Equal(t, float64(5), testutil.ToFloat64(metrics.bufLen.WithLabelValues("metrics", "pending")))
+	assert.Equal(t, float64(10), testutil.ToFloat64(metrics.bufCap.WithLabelValues("metrics", "pending")))
+
+	_, err = reg.Gather()
+	assert.NoError(t, err, "must not be an error")
+}
@@ -0,0 +1,55 @@
+package ami
+
+import (
+	"context"
+
+	"github.com/ssgreg/repeat"
+)
+
+// retry calls fn until it succeeds, policy is exhausted, error is permanent
+// or context is done.
+// onRetry is called for every failed attempt, that will be retried.
+func (r RetryPolicy) retry(ctx context.Context, fn func() error, onRetry func(err error)) error {
+	backoff := repeat.FullJitterBackoff(r.BaseDelay)
+	if r.MaxDelay > 0 {
+		backoff = backoff.WithMaxDelay(r.MaxDelay)
+	}
+
+	delay := []func(*repeat.DelayOptions){
+		backoff.Set(),
+		repeat.SetContext(ctx),
+	}
+
+	if r.MaxElapsedTime > 0 {
+		delay = append(delay, repeat.SetErrorsTimeout(r.MaxElapsedTime))
+	}
+
+	attempts := 0
+
+	return repeat.Repeat(
+		repeat.Fn(func() error {
+			err := fn()
+			if err == nil {
+				return nil
+			}
+
+			attempts++
+
+			if r.MaxAttempts > 0 && attempts >= r.MaxAttempts {
+				return err
+			}
+
+			if r.IsPermanent != nil && r.IsPermanent(err) {
+				return err
+			}
+
+			if onRetry != nil {
+				onRetry(err)
+			}
+
+			return repeat.HintTemporary(err)
+		}),
+		repeat.StopOnSuccess(),
+		repeat.WithDelay(delay...),
+	)
+}
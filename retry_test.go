@@ -0,0 +1,119 @@
+package ami
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v7"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	errTest := errors.New("test")
+
+	var attempts, retries int
+
+	fn := func() error {
+		attempts++
+		return errTest
+	}
+
+	onRetry := func(err error) {
+		retries++
+	}
+
+	r := RetryPolicy{BaseDelay: time.Millisecond, MaxAttempts: 3}
+
+	err := r.retry(context.Background(), fn, onRetry)
+	assert.Equal(t, errTest, err)
+	assert.Equal(t, 3, attempts)
+	assert.Equal(t, 2, retries)
+
+	attempts, retries = 0, 0
+
+	r = RetryPolicy{
+		BaseDelay:   time.Millisecond,
+		IsPermanent: func(err error) bool { return err == errTest },
+	}
+
+	err = r.retry(context.Background(), fn, onRetry)
+	assert.Equal(t, errTest, err)
+	assert.Equal(t, 1, attempts)
+	assert.Equal(t, 0, retries)
+
+	r = RetryPolicy{
+		BaseDelay:      time.Millisecond,
+		MaxDelay:       time.Millisecond * 10,
+		MaxElapsedTime: time.Millisecond * 100,
+	}
+
+	started := time.Now()
+
+	err = r.retry(context.Background(), fn, nil)
+	assert.Equal(t, errTest, err)
+	assert.True(t, time.Since(started) < time.Second)
+
+	attempts = 0
+
+	err = r.retry(context.Background(), func() error {
+		attempts++
+		if attempts < 3 {
+			return errTest
+		}
+
+		return nil
+	}, nil)
+	assert.NoError(t, err, "must not be an error")
+	assert.Equal(t, 3, attempts)
+}
+
+func TestFailNotifier(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	rdOpt := &redis.ClusterOptions{Addrs: []string{s.Addr()}}
+
+	fail := &failNotifier{C: make(chan []Message, 1)}
+
+	p, err := NewProducer(ProducerOptions{
+		FailNotifier: fail,
+		Name:         "fail",
+		RetryPolicy:  RetryPolicy{MaxAttempts: 2},
+		ShardsCount:  1,
+	}, rdOpt)
+	assert.NoError(t, err, "must not be an error")
+
+	s.Close()
+
+	f := p.SendAsync("1")
+
+	select {
+	case msgs := <-fail.C:
+		assert.Len(t, msgs, 1)
+		assert.Equal(t, "1", msgs[0].Body)
+		assert.Equal(t, "qu{0}_fail", msgs[0].Stream)
+	case <-time.After(time.Second * 5):
+		assert.FailNow(t, "must not wait for a long time")
+	}
+
+	_, err = f.Result()
+	assert.Error(t, err, "must be an error")
+
+	p.Close()
+}
+
+type failNotifier struct {
+	C chan []Message
+}
+
+func (n *failNotifier) AmiFailed(op string, msgs []Message, err error) {
+	if op == "send" {
+		n.C <- msgs
+	}
+}
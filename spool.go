@@ -0,0 +1,449 @@
+package ami
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+)
+
+// ErrSpooled is the error of message, that is not sent to Redis, but is written
+// to spool and will be sent later.
+var ErrSpooled = errors.New("Message is not sent to Redis and is written to spool")
+
+var errSpoolCorrupted = errors.New("Spool segment is corrupted")
+
+// Extension of spool segment files
+const spoolExt = ".spool"
+
+// Maximum size of one record of spool segment. Bigger batches are not
+// spooled.
+const maxSpoolRecordSize = 512 * 1024 * 1024
+
+// spool of not sent batches of producer.
+//
+// Batches are appended to segment files "<queue>.<N>.spool" as records:
+// length of payload, payload and CRC32 of payload. Payload is stream name and
+// fields of all messages of batch.
+type spool struct {
+	dir      string
+	dirty    bool
+	f        *os.File
+	mu       sync.Mutex
+	name     string
+	policy   SpoolSyncPolicy
+	segSize  int64
+	size     int64
+	segments int64 // Counter to get unique names of segments
+}
+
+func newSpool(dir string, name string, policy SpoolSyncPolicy, segSize int64) (*spool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	return &spool{dir: dir, name: name, policy: policy, segSize: segSize}, nil
+}
+
+// write appends batch to current segment.
+func (s *spool) write(args []redis.XAddArgs) error {
+	rec := encodeSpoolRecord(args)
+	if len(rec) > maxSpoolRecordSize {
+		return fmt.Errorf("Batch of %d bytes is too big for spool", len(rec))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.f == nil {
+		s.segments++
+
+		path := filepath.Join(s.dir, fmt.Sprintf("%s.%020d.%06d%s", s.name, time.Now().UnixNano(), s.segments%1000000, spoolExt))
+
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+
+		s.f = f
+		s.size = 0
+	}
+
+	if _, err := s.f.Write(rec); err != nil {
+		return err
+	}
+
+	s.size += int64(len(rec))
+
+	if s.policy == SpoolSyncAlways {
+		if err := s.f.Sync(); err != nil {
+			return err
+		}
+	} else {
+		s.dirty = true
+	}
+
+	if s.size >= s.segSize {
+		return s.closeSegment()
+	}
+
+	return nil
+}
+
+// sync flushes current segment to disk, if it has not synced records.
+func (s *spool) sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.f == nil || !s.dirty {
+		return nil
+	}
+
+	s.dirty = false
+
+	return s.f.Sync()
+}
+
+// close closes current segment.
+func (s *spool) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.closeSegment()
+}
+
+func (s *spool) closeSegment() error {
+	if s.f == nil {
+		return nil
+	}
+
+	f := s.f
+	s.f = nil
+
+	if s.policy != SpoolSyncNever {
+		if err := f.Sync(); err != nil {
+			_ = f.Close()
+			return err
+		}
+	}
+
+	return f.Close()
+}
+
+// closedSegments closes current segment and returns paths of all segments in
+// order of creation.
+func (s *spool) closedSegments() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.closeSegment(); err != nil {
+		return nil, err
+	}
+
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+
+	for _, f := range files {
+		if f.IsDir() || !s.isSegment(f.Name()) {
+			continue
+		}
+
+		paths = append(paths, filepath.Join(s.dir, f.Name()))
+	}
+
+	sort.Strings(paths)
+
+	return paths, nil
+}
+
+// isSegment checks, that file is segment of spool of this queue
+// "<queue>.<N>.<N>.spool".
+func (s *spool) isSegment(file string) bool {
+	if !strings.HasPrefix(file, s.name+".") || !strings.HasSuffix(file, spoolExt) {
+		return false
+	}
+
+	num := strings.TrimSuffix(strings.TrimPrefix(file, s.name+"."), spoolExt)
+
+	parts := strings.Split(num, ".")
+	if len(parts) != 2 {
+		return false
+	}
+
+	for _, p := range parts {
+		if p == "" || strings.Trim(p, "0123456789") != "" {
+			return false
+		}
+	}
+
+	return true
+}
+
+// readSpoolSegment calls fn for every batch of segment.
+// Incompletely written record at the end of segment is ignored. Record with
+// length bigger then maxSpoolRecordSize is never written, so it is considered
+// as corrupted tail of segment and is ignored too.
+func readSpoolSegment(path string, fn func(args []redis.XAddArgs) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+
+	for {
+		size, err := binary.ReadUvarint(r)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		// Length can be broken only by corruption, because it is not covered
+		// by CRC
+		if size > maxSpoolRecordSize {
+			return nil
+		}
+
+		rec := make([]byte, size+4)
+
+		_, err = io.ReadFull(r, rec)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		payload := rec[:size]
+
+		if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(rec[size:]) {
+			return fmt.Errorf("%w: %s", errSpoolCorrupted, path)
+		}
+
+		args, err := decodeSpoolRecord(payload)
+		if err != nil {
+			return fmt.Errorf("%w: %s: %s", errSpoolCorrupted, path, err.Error())
+		}
+
+		if err := fn(args); err != nil {
+			return err
+		}
+	}
+}
+
+func encodeSpoolRecord(args []redis.XAddArgs) []byte {
+	var payload []byte
+
+	payload = appendSpoolBytes(payload, []byte(args[0].Stream))
+	payload = appendUvarint(payload, uint64(len(args)))
+
+	for _, a := range args {
+		payload = appendUvarint(payload, uint64(len(a.Values)))
+
+		for k, v := range a.Values {
+			payload = appendSpoolBytes(payload, []byte(k))
+
+			switch val := v.(type) {
+			case string:
+				payload = appendSpoolBytes(payload, []byte(val))
+			case []byte:
+				payload = appendSpoolBytes(payload, val)
+			default:
+				payload = appendSpoolBytes(payload, []byte(fmt.Sprint(val)))
+			}
+		}
+	}
+
+	rec := appendUvarint(make([]byte, 0, len(payload)+binary.MaxVarintLen64+4), uint64(len(payload)))
+	rec = append(rec, payload...)
+
+	crc := make([]byte, 4)
+	binary.LittleEndian.PutUint32(crc, crc32.ChecksumIEEE(payload))
+
+	return append(rec, crc...)
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	b := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(b, v)
+
+	return append(buf, b[:n]...)
+}
+
+func appendSpoolBytes(buf []byte, b []byte) []byte {
+	buf = appendUvarint(buf, uint64(len(b)))
+	return append(buf, b...)
+}
+
+func decodeSpoolRecord(payload []byte) ([]redis.XAddArgs, error) {
+	r := &spoolReader{buf: payload}
+
+	stream := string(r.bytes())
+	count := r.uvarint()
+
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	args := make([]redis.XAddArgs, 0, count)
+
+	for i := uint64(0); i < count; i++ {
+		fields := r.uvarint()
+		values := make(map[string]interface{}, fields)
+
+		for j := uint64(0); j < fields && r.err == nil; j++ {
+			k := string(r.bytes())
+			values[k] = string(r.bytes())
+		}
+
+		if r.err != nil {
+			return nil, r.err
+		}
+
+		args = append(args, redis.XAddArgs{ID: "*", Stream: stream, Values: values})
+	}
+
+	return args, nil
+}
+
+type spoolReader struct {
+	buf []byte
+	err error
+}
+
+func (r *spoolReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+
+	v, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		r.err = errors.New("Incorrect length")
+		return 0
+	}
+
+	r.buf = r.buf[n:]
+
+	return v
+}
+
+func (r *spoolReader) bytes() []byte {
+	size := r.uvarint()
+	if r.err != nil {
+		return nil
+	}
+
+	if uint64(len(r.buf)) < size {
+		r.err = errors.New("Unexpected end of record")
+		return nil
+	}
+
+	b := r.buf[:size]
+	r.buf = r.buf[size:]
+
+	return b
+}
+
+// replaySpool periodically sends spooled batches until producer is closed.
+func (p *Producer) replaySpool() {
+	defer p.wgBg.Done()
+
+	replay := time.NewTicker(p.opt.SpoolReplayPeriod)
+	defer replay.Stop()
+
+	syncTick := time.NewTicker(p.opt.SpoolSyncPeriod)
+	defer syncTick.Stop()
+
+	// Send batches, spooled before restart
+	p.sendSpooled()
+
+	for {
+		var doStop bool
+
+		select {
+		case <-p.ctx.Done():
+			doStop = true
+		case <-syncTick.C:
+			if err := p.spool.sync(); err != nil && p.notif != nil {
+				p.notif.AmiError(err)
+			}
+
+			continue
+		case <-replay.C:
+		}
+
+		if doStop {
+			break
+		}
+
+		p.sendSpooled()
+	}
+}
+
+// sendSpooled sends all closed segments of spool and deletes them.
+// Sending is stopped at first error and is continued from failed segment next
+// time, so some batches may be sent twice.
+func (p *Producer) sendSpooled() {
+	paths, err := p.spool.closedSegments()
+	if err != nil {
+		if p.notif != nil {
+			p.notif.AmiError(err)
+		}
+
+		return
+	}
+
+	for _, path := range paths {
+		if p.ctx.Err() != nil {
+			return
+		}
+
+		err := readSpoolSegment(path, func(args []redis.XAddArgs) error {
+			pipe := p.cl.rDB.TxPipeline()
+
+			for i := range args {
+				args[i].MaxLenApprox = p.opt.MaxLen
+				pipe.XAdd(&args[i])
+			}
+
+			_, err := pipe.Exec()
+
+			return err
+		})
+
+		if errors.Is(err, errSpoolCorrupted) {
+			if p.notif != nil {
+				p.notif.AmiError(err)
+			}
+
+			// Keep corrupted segment for manual recovery
+			err = os.Rename(path, path+".corrupted")
+		} else if err == nil {
+			err = os.Remove(path)
+		}
+
+		if err != nil {
+			if p.notif != nil {
+				p.notif.AmiError(err)
+			}
+
+			return
+		}
+	}
+}
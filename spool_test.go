@@ -0,0 +1,209 @@
+package ami
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v7"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpool(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	dir, err := ioutil.TempDir("", "ami")
+	assert.NoError(t, err, "must not be an error")
+	defer os.RemoveAll(dir)
+
+	rdOpt := &redis.ClusterOptions{Addrs: []string{s.Addr()}}
+
+	p, err := NewProducer(ProducerOptions{
+		Name:        "spool",
+		RetryPolicy: RetryPolicy{MaxAttempts: 1},
+		ShardsCount: 1,
+		SpoolDir:    dir,
+	}, rdOpt)
+	assert.NoError(t, err, "must not be an error")
+
+	s.Close()
+
+	f := p.SendAsync("1")
+	p.SendBytes([]byte{0, 1, 2})
+
+	_, err = f.Result()
+	assert.Equal(t, ErrSpooled, err)
+
+	p.Close()
+
+	files, err := filepath.Glob(filepath.Join(dir, "spool.*.spool"))
+	assert.NoError(t, err, "must not be an error")
+	assert.NotEmpty(t, files)
+
+	err = s.Restart()
+	assert.NoError(t, err, "must not be an error")
+
+	// New producer sends spooled messages on start, like after restart
+	p, err = NewProducer(ProducerOptions{
+		Name:        "spool",
+		ShardsCount: 1,
+		SpoolDir:    dir,
+	}, rdOpt)
+	assert.NoError(t, err, "must not be an error")
+
+	i, err := NewInspector(InspectorOptions{Name: "spool", ShardsCount: 1}, rdOpt)
+	assert.NoError(t, err, "must not be an error")
+
+	var lst []Message
+
+	for n := 0; n < 50 && len(lst) < 2; n++ {
+		time.Sleep(time.Millisecond * 100)
+
+		lst, err = i.Peek(10)
+		assert.NoError(t, err, "must not be an error")
+	}
+
+	assert.Len(t, lst, 2)
+	assert.ElementsMatch(t, []string{"1", string([]byte{0, 1, 2})}, []string{lst[0].Body, lst[1].Body})
+
+	p.Close()
+
+	files, err = filepath.Glob(filepath.Join(dir, "spool.*.spool"))
+	assert.NoError(t, err, "must not be an error")
+	assert.Empty(t, files)
+}
+
+func TestSpoolCloseContext(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	dir, err := ioutil.TempDir("", "ami")
+	assert.NoError(t, err, "must not be an error")
+	defer os.RemoveAll(dir)
+
+	rdOpt := &redis.ClusterOptions{Addrs: []string{s.Addr()}}
+
+	// Default RetryPolicy retries sending to dead Redis until close
+	p, err := NewProducer(ProducerOptions{
+		Name:        "spool",
+		ShardsCount: 1,
+		SpoolDir:    dir,
+	}, rdOpt)
+	assert.NoError(t, err, "must not be an error")
+
+	s.Close()
+
+	f := p.SendAsync("1")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+
+	<-ctx.Done()
+
+	assert.Equal(t, context.DeadlineExceeded, p.CloseContext(ctx))
+
+	_, err = f.Result()
+	assert.Equal(t, ErrSpooled, err)
+
+	err = s.Restart()
+	assert.NoError(t, err, "must not be an error")
+
+	p, err = NewProducer(ProducerOptions{
+		Name:        "spool",
+		ShardsCount: 1,
+		SpoolDir:    dir,
+	}, rdOpt)
+	assert.NoError(t, err, "must not be an error")
+
+	i, err := NewInspector(InspectorOptions{Name: "spool", ShardsCount: 1}, rdOpt)
+	assert.NoError(t, err, "must not be an error")
+
+	var lst []Message
+
+	for n := 0; n < 50 && len(lst) < 1; n++ {
+		time.Sleep(time.Millisecond * 100)
+
+		lst, err = i.Peek(10)
+		assert.NoError(t, err, "must not be an error")
+	}
+
+	if assert.Len(t, lst, 1) {
+		assert.Equal(t, "1", lst[0].Body)
+	}
+
+	p.Close()
+}
+
+func TestSpoolSegment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ami")
+	assert.NoError(t, err, "must not be an error")
+	defer os.RemoveAll(dir)
+
+	sp, err := newSpool(dir, "segment", SpoolSyncPeriodic, 1024)
+	assert.NoError(t, err, "must not be an error")
+
+	args := []redis.XAddArgs{
+		{Stream: "qu{0}_segment", Values: map[string]interface{}{"m": "1", "h:k": "v"}},
+		{Stream: "qu{0}_segment", Values: map[string]interface{}{"m": []byte{0, 255}}},
+	}
+
+	assert.NoError(t, sp.write(args), "must not be an error")
+	assert.NoError(t, sp.sync(), "must not be an error")
+
+	paths, err := sp.closedSegments()
+	assert.NoError(t, err, "must not be an error")
+	assert.Len(t, paths, 1)
+
+	// Incompletely written record
+	fh, err := os.OpenFile(paths[0], os.O_WRONLY|os.O_APPEND, 0644)
+	assert.NoError(t, err, "must not be an error")
+	_, err = fh.Write([]byte{100, 1, 2})
+	assert.NoError(t, err, "must not be an error")
+	assert.NoError(t, fh.Close(), "must not be an error")
+
+	var got []redis.XAddArgs
+
+	err = readSpoolSegment(paths[0], func(a []redis.XAddArgs) error {
+		got = append(got, a...)
+		return nil
+	})
+	assert.NoError(t, err, "must not be an error")
+	assert.Len(t, got, 2)
+	assert.Equal(t, "qu{0}_segment", got[0].Stream)
+	assert.Equal(t, map[string]interface{}{"m": "1", "h:k": "v"}, got[0].Values)
+	assert.Equal(t, map[string]interface{}{"m": string([]byte{0, 255})}, got[1].Values)
+
+	// Corrupted record
+	data, err := ioutil.ReadFile(paths[0])
+	assert.NoError(t, err, "must not be an error")
+	data[5]++
+	assert.NoError(t, ioutil.WriteFile(paths[0], data, 0644), "must not be an error")
+
+	err = readSpoolSegment(paths[0], func(a []redis.XAddArgs) error { return nil })
+	assert.Error(t, err, "must be an error")
+
+	// Impossible length of record is corrupted tail
+	fh, err = os.OpenFile(paths[0], os.O_WRONLY|os.O_TRUNC, 0644)
+	assert.NoError(t, err, "must not be an error")
+	_, err = fh.Write(appendUvarint(nil, maxSpoolRecordSize+1))
+	assert.NoError(t, err, "must not be an error")
+	assert.NoError(t, fh.Close(), "must not be an error")
+
+	err = readSpoolSegment(paths[0], func(a []redis.XAddArgs) error { return nil })
+	assert.NoError(t, err, "must not be an error")
+
+	assert.False(t, sp.isSegment("segment.1.spool"))
+	assert.False(t, sp.isSegment("other.1.1.spool"))
+	assert.True(t, sp.isSegment("segment.1.1.spool"))
+}
@@ -0,0 +1,100 @@
+package ami
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+)
+
+// ErrRetentionUnsupported is reported to ErrorNotifier, if Redis doesn't
+// support XTRIM MINID (Redis before 6.2). Trimming by Retention is disabled
+// after it and only MaxLen is used.
+var ErrRetentionUnsupported = errors.New("Retention requires Redis 6.2 or later: XTRIM MINID is not supported")
+
+// trim periodically trims all shards of queue until producer is closed.
+func (p *Producer) trim() {
+	defer p.wgBg.Done()
+
+	tick := time.NewTicker(p.opt.TrimPeriod)
+	defer tick.Stop()
+
+	retention := p.opt.Retention
+
+	for {
+		var doStop bool
+
+		select {
+		case <-p.ctx.Done():
+			doStop = true
+		case <-tick.C:
+		}
+
+		if doStop {
+			break
+		}
+
+		for i := 0; i < int(p.opt.ShardsCount); i++ {
+			stream := fmt.Sprintf("qu{%d}_%s", i, p.opt.Name)
+
+			cnt, err := p.cl.trimStream(stream, p.opt.MaxLen, retention)
+			if err == ErrRetentionUnsupported {
+				retention = 0
+			}
+
+			if err != nil && p.notif != nil {
+				p.notif.AmiError(err)
+			}
+
+			if cnt > 0 && p.opt.TrimNotifier != nil {
+				p.opt.TrimNotifier.AmiTrimmed(stream, cnt)
+			}
+		}
+	}
+}
+
+// trimStream trims stream by approximate length and retention period, if they
+// are set. Returns amount of deleted messages.
+func (c *client) trimStream(stream string, maxLen int64, retention time.Duration) (int64, error) {
+	var total int64
+
+	if maxLen > 0 {
+		cnt, err := c.rDB.XTrimApprox(stream, maxLen).Result()
+		if err != nil && err != redis.Nil {
+			return total, err
+		}
+
+		total += cnt
+	}
+
+	if retention > 0 {
+		minID := fmt.Sprintf("%d-0", time.Now().Add(-retention).UnixNano()/int64(time.Millisecond))
+
+		cmd := redis.NewIntCmd("XTRIM", stream, "MINID", "~", minID)
+
+		err := c.rDB.Process(cmd)
+		if isMinIDUnsupported(err) {
+			return total, ErrRetentionUnsupported
+		}
+
+		if err != nil && err != redis.Nil {
+			return total, err
+		}
+
+		total += cmd.Val()
+	}
+
+	return total, nil
+}
+
+// isMinIDUnsupported checks, if error is rejection of MINID strategy of XTRIM
+// by Redis before 6.2.
+func isMinIDUnsupported(err error) bool {
+	if err == nil || err == redis.Nil {
+		return false
+	}
+
+	return strings.HasPrefix(err.Error(), "ERR syntax error")
+}
@@ -0,0 +1,84 @@
+package ami
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v7"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrim(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	rdOpt := &redis.ClusterOptions{Addrs: []string{s.Addr()}}
+
+	rDB := redis.NewClusterClient(rdOpt)
+	defer rDB.Close()
+
+	// Old messages. IDs have same length as current to workaround string
+	// comparison of IDs in miniredis
+	for i := 1; i <= 2; i++ {
+		err := rDB.XAdd(&redis.XAddArgs{
+			ID:     fmt.Sprintf("100000000000%d-0", i),
+			Stream: "qu{0}_trim",
+			Values: map[string]interface{}{"m": "old"},
+		}).Err()
+		assert.NoError(t, err, "must not be an error")
+	}
+
+	ntf := &trimNotifier{Trimmed: make(chan int64, 10)}
+
+	p, err := NewProducer(ProducerOptions{
+		Name:         "trim",
+		Retention:    time.Hour,
+		ShardsCount:  1,
+		TrimNotifier: ntf,
+		TrimPeriod:   time.Millisecond * 10,
+	}, rdOpt)
+	assert.NoError(t, err, "must not be an error")
+
+	select {
+	case cnt := <-ntf.Trimmed:
+		assert.Equal(t, int64(2), cnt)
+	case <-time.After(time.Second):
+		assert.FailNow(t, "must trim old messages")
+	}
+
+	p.Close()
+
+	for i := 0; i < 5; i++ {
+		err := rDB.XAdd(&redis.XAddArgs{
+			Stream: "qu{0}_trim",
+			Values: map[string]interface{}{"m": "ok"},
+		}).Err()
+		assert.NoError(t, err, "must not be an error")
+	}
+
+	cnt, err := p.cl.trimStream("qu{0}_trim", 3, time.Hour)
+	assert.NoError(t, err, "must not be an error")
+	assert.Equal(t, int64(2), cnt)
+	assert.Equal(t, int64(3), rDB.XLen("qu{0}_trim").Val())
+}
+
+func TestMinIDUnsupported(t *testing.T) {
+	assert.True(t, isMinIDUnsupported(errors.New("ERR syntax error")))
+	assert.False(t, isMinIDUnsupported(errors.New("ERR no such key")))
+	assert.False(t, isMinIDUnsupported(redis.Nil))
+	assert.False(t, isMinIDUnsupported(nil))
+}
+
+type trimNotifier struct {
+	Trimmed chan int64
+}
+
+func (n *trimNotifier) AmiTrimmed(stream string, count int64) {
+	n.Trimmed <- count
+}
@@ -1,6 +1,7 @@
 package ami
 
 import (
+	"context"
 	"sync"
 	"time"
 
@@ -8,22 +9,52 @@ import (
 )
 
 // Message from queue
+//
+// Redis streams are binary safe, so Body may contain any binary data, sent
+// with SendBytes. Use Bytes() to get it as byte slice.
 type Message struct {
 	Body   string // Message content, you interested in
 	ID     string // ID of message in Redis stream
 	Stream string // Redis stream name
 	Group  string // Redis stream group name
+
+	// Message attributes, like trace IDs, content type and etc.
+	// Headers are stored in stream as additional fields with "h:" prefix.
+	Headers map[string]string
+
+	// Count of Nack calls for this message. Incremented on every Nack.
+	Retries int
+
+	ctx     context.Context // Context of message, set by Tracer
+	settled *int32          // Set by Ack or Nack of message, got in Run
+}
+
+// DeadMessage from dead-letter stream of queue
+type DeadMessage struct {
+	Body           string // Message content
+	ID             string // ID of message in dead-letter stream
+	Stream         string // Dead-letter stream name
+	OriginalID     string // ID of message in queue stream before moving
+	OriginalStream string // Queue stream name
+	Group          string // Consumer group, from which message was moved
+	Deliveries     int64  // Delivery count at the moment of moving
+	Error          string // Reason of moving and last error of processing
+
+	Headers map[string]string // Message attributes
 }
 
 type client struct {
 	opt clientOptions
-	rDB *redis.ClusterClient
+	rDB redis.UniversalClient
 }
 
 type clientOptions struct {
+	groups      []string
 	name        string
+	rDB         redis.UniversalClient
 	ropt        *redis.ClusterOptions
 	shardsCount int8
+	startID     string
 }
 
 // Producer client for Ami.
@@ -34,13 +65,42 @@ type clientOptions struct {
 //
 // 2. Application send messages with Producer object.
 //
-// 3. Close() - locks until all produced messages will be sent to Redis.
+// 3. Close() or CloseContext() - locks until all produced messages will be sent
+// to Redis.
 type Producer struct {
-	c     chan string
-	cl    *client
-	notif ErrorNotifier
-	opt   ProducerOptions
-	wg    *sync.WaitGroup
+	c        chan toSend
+	cancel   context.CancelFunc
+	cl       *client
+	ctx      context.Context
+	delayed  uint32 // Counter to select shard of delayed messages
+	inFlight chan struct{}
+	metr     MetricsNotifier
+	notif    ErrorNotifier
+	opt      ProducerOptions
+	ordered  []chan struct{}
+	pending  *bytesLimit
+	spool    *spool
+	wg       *sync.WaitGroup
+	wgBg     *sync.WaitGroup // Background goroutines, stopped by cancel
+}
+
+// toSend is message in send buffer of producer.
+// It is smaller then Message, because send buffer may be huge: it takes 24
+// bytes, optional fields are allocated separately only for messages, that use
+// them.
+type toSend struct {
+	body  string
+	extra *toSendExtra
+}
+
+// toSendExtra - optional fields of message in send buffer.
+type toSendExtra struct {
+	bytes   []byte // Body of SendBytes, is sent without copying
+	headers map[string]string
+	result  *Future
+	traced  func(id string, err error) // Set by Tracer
+	shard   int32                      // Shard of message with key
+	keyed   bool
 }
 
 // ProducerOptions - options for producer client for Ami
@@ -56,6 +116,19 @@ type ProducerOptions struct {
 	// Queue name
 	Name string
 
+	// Consumer groups, that are created by producer, if they don't exist.
+	// Default is one group "qu_<name>_group".
+	//
+	// Set it to groups of all consumers of queue, if queue has several groups
+	// (see ConsumerOptions.Group), so messages, sent before first start of
+	// consumers, are got by all groups.
+	Groups []string
+
+	// Position in streams, from which not existing groups are created:
+	// "$" - only new messages, "0" - all messages in streams, or explicit
+	// stream ID. Default "$".
+	GroupStartID string
+
 	// Shard queue along different Redis Cluster nodes. Default 10.
 	//
 	// Ami queues spreads along cluster by default Redis Cluster ability - shards.
@@ -76,6 +149,10 @@ type ProducerOptions struct {
 	// Bigger value got better ACK performance and bigger memory usage.
 	// If you your process dies with big amount of ACKed messages, but not already
 	// sended to Redis - ACKs will be lost and messages will be processed again.
+	//
+	// Buffer is allocated at start of producer and takes 24 bytes per slot,
+	// 240MB with default size, plus size of messages in it. Messages with key,
+	// headers, binary body, result or Tracer take 56 bytes more.
 	PendingBufferSize int64
 
 	// Request to Redis sended in pipe mode with setuped numbers of requests in
@@ -91,32 +168,204 @@ type ProducerOptions struct {
 	// If you set optional ErrorNotifier, you will receiving errors notifications
 	// in interface function
 	ErrorNotifier ErrorNotifier
+
+	// Approximate maximum length of every shard stream. Default 0 - unlimited.
+	//
+	// Used as MAXLEN ~ option of XADD and by background trimmer.
+	// Pay attention, that not processed messages are deleted too, if consumers
+	// are slower then producers.
+	MaxLen int64
+
+	// Retention period of messages in queue. Default 0 - unlimited.
+	//
+	// Background trimmer deletes messages, older then this period, with
+	// XTRIM MINID ~. Redis 6.2 or later is required: with older Redis
+	// ErrRetentionUnsupported is reported to ErrorNotifier once and only MaxLen
+	// is used.
+	// Pay attention, that not processed messages are deleted too.
+	Retention time.Duration
+
+	// Period of background trimming of streams. Default time.Minute.
+	//
+	// Used only if MaxLen or Retention is set.
+	TrimPeriod time.Duration
+
+	// If you set optional TrimNotifier, you will receiving notifications about
+	// amount of trimmed messages in interface function
+	TrimNotifier TrimNotifier
+
+	// If you set optional MetricsNotifier, you will receiving metrics of
+	// producer in interface functions
+	MetricsNotifier MetricsNotifier
+
+	// If you set optional Tracer, every sent message is traced and trace
+	// context is propagated to consumers in message headers.
+	Tracer Tracer
+
+	// Policy of retries of sending to Redis. Default is infinite retries with
+	// full jitter backoff with 500ms base delay.
+	//
+	// If retries are exhausted, batch of messages is passed to FailNotifier,
+	// if it is set, and is dropped.
+	RetryPolicy RetryPolicy
+
+	// If you set optional FailNotifier, you will receiving messages, that are
+	// failed to send to Redis, in interface function. So they can be logged,
+	// stored or sent again.
+	FailNotifier FailNotifier
+
+	// Directory of spool of not sent messages. Default "" - spool is disabled.
+	//
+	// If sending of batch is failed after all retries of RetryPolicy, batch is
+	// appended to segment file "<name>.<N>.<N>.spool" in this directory
+	// instead of passing to FailNotifier. Results of such messages are
+	// ErrSpooled.
+	// Spooled batches are periodically sent again by producer, including
+	// batches, spooled before restart of process. Batches are deleted from
+	// spool after sending, so some of them may be sent twice, if sending is
+	// interrupted. Spooled messages are not ordered with other messages.
+	// With default infinite RetryPolicy batches are spooled only on close, so
+	// set MaxAttempts or MaxElapsedTime of RetryPolicy to spool batches
+	// during Redis outages.
+	// Directory must not be shared by producers of same queue.
+	SpoolDir string
+
+	// Policy of fsync of spool segment files. Default SpoolSyncAlways.
+	SpoolSync SpoolSyncPolicy
+
+	// Period of fsync of spool segment files with SpoolSyncPeriodic policy.
+	// Default time.Second.
+	SpoolSyncPeriod time.Duration
+
+	// Period of sending of spooled batches. Default time.Second * 10.
+	SpoolReplayPeriod time.Duration
+
+	// Maximum size of spool segment file in bytes. Default 64 MB.
+	//
+	// Segment is sent and deleted only after it is closed by size or by
+	// start of sending of spooled batches.
+	SpoolSegmentSize int64
+
+	// Policy of Send, when send buffer is full. Default OverflowBlock.
+	OverflowPolicy OverflowPolicy
+
+	// Timeout of waiting of free space in send buffer for
+	// OverflowBlockWithTimeout policy. Default time.Second.
+	OverflowTimeout time.Duration
+
+	// Maximum amount of batches, that are sending to Redis at same time.
+	// Default 0 - unlimited.
+	//
+	// Every batch is sent in separate goroutine with retries. If Redis is
+	// slow, amount of such goroutines and memory usage can grow fast. If limit
+	// is reached, collecting of next batch waits for finish of one of sending
+	// batches, and send buffer is filled (see OverflowPolicy).
+	MaxInFlightPipelines int
+
+	// Maximum total size of messages in send buffer in bytes.
+	// Default 0 - unlimited.
+	//
+	// Size of message is size of body and headers. If limit is reached, send
+	// buffer is full, as if it contains PendingBufferSize messages (see
+	// OverflowPolicy). Message bigger than limit is accepted only to empty
+	// buffer. Memory of batches, that are sending to Redis, is not counted,
+	// use MaxInFlightPipelines and MaxPipeBytes to limit it.
+	MaxPendingBytes int64
+
+	// Maximum total size of messages in one batch in bytes.
+	// Default 0 - unlimited.
+	//
+	// Batch is sent, when it contains PipeBufferSize messages or MaxPipeBytes
+	// bytes, whichever comes first. Message bigger than limit is sent in
+	// separate batch.
+	MaxPipeBytes int64
 }
 
+// OverflowPolicy - policy of Send, when send buffer of producer is full.
+//
+// Dropped messages are passed to FailNotifier with op "overflow" and their
+// futures are resolved with ErrOverflow.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock - Send locks until there will be free space in buffer or
+	// context of SendContext or SendSync is done.
+	OverflowBlock OverflowPolicy = iota
+
+	// OverflowBlockWithTimeout - Send locks not longer then OverflowTimeout,
+	// then message is dropped. SendContext and SendSync return ErrOverflow.
+	OverflowBlockWithTimeout
+
+	// OverflowDropNewest - sending message is dropped. SendContext and
+	// SendSync return ErrOverflow.
+	OverflowDropNewest
+
+	// OverflowDropOldest - oldest message in buffer is dropped to free space
+	// for sending message. Sending message is pushed to buffer, so SendContext
+	// returns nil, dropped message is passed to FailNotifier.
+	OverflowDropOldest
+
+	// OverflowReturnError - sending message is dropped, SendContext and
+	// SendSync return ErrOverflow, ErrOverflow is sent to ErrorNotifier.
+	OverflowReturnError
+)
+
+// SpoolSyncPolicy - policy of fsync of spool segment files.
+type SpoolSyncPolicy int
+
+const (
+	// SpoolSyncAlways - fsync after every written batch.
+	SpoolSyncAlways SpoolSyncPolicy = iota
+
+	// SpoolSyncPeriodic - fsync every SpoolSyncPeriod and on close of
+	// segment. Batches, written after last fsync, may be lost on crash of OS.
+	SpoolSyncPeriodic
+
+	// SpoolSyncNever - fsync is never done, OS writes files to disk by
+	// itself.
+	SpoolSyncNever
+)
+
 // Consumer client for Ami.
 //
 // Consumer lifecycle is:
 //
 // 1. Get Consumer object.
 //
-// 2. Start() - start read messages from Redis streams and return channel.
+// 2. Start() or StartContext() - start read messages from Redis streams and
+// return channel.
 //
-// 3. Application read messages from channel and do Ack() on them.
+// 3. Application read messages from channel and do Ack() or Nack() on them.
 //
-// 4. Stop() - stop reading messages from Redis streams and lock until all
-// read messages being processed.
+// 4. Stop() - stop reading messages from Redis streams and lock until
+// consumer channel is closed.
 //
-// 5. Close() - lock until all ACK messages will be sent to Redis.
+// 5. Close() or CloseContext() - lock until all ACK messages will be sent to
+// Redis.
 type Consumer struct {
-	cAck     chan Message
-	cCons    chan Message
-	cl       *client
-	needStop bool
-	notif    ErrorNotifier
-	opt      ConsumerOptions
-	stopped  bool
-	wgAck    *sync.WaitGroup
-	wgCons   *sync.WaitGroup
+	cAck        chan toAck
+	cCons       chan Message
+	cStopped    chan struct{}
+	cancel      context.CancelFunc
+	cancelAck   context.CancelFunc
+	cl          *client
+	ctx         context.Context
+	ctxAck      context.Context
+	inFlight    chan struct{}
+	metr        MetricsNotifier
+	notif       ErrorNotifier
+	opt         ConsumerOptions
+	wakeDelayed []chan struct{} // Wakes up moving of delayed messages of shard
+	wgAck       *sync.WaitGroup
+	wgCons      *sync.WaitGroup
+}
+
+// toAck is message in ACK buffer of consumer.
+// It is smaller then Message, because ACK buffer may be huge.
+type toAck struct {
+	group  string
+	id     string
+	stream string
 }
 
 // ConsumerOptions - options for consumer client for Ami.
@@ -145,10 +394,29 @@ type ConsumerOptions struct {
 	// messages, processes them, and only one can ACK message, and second will
 	// retry ACKing of this message forever.
 	//
-	// Now there is no mechanism in Ami, than can move messages from one consumer
-	// to other and I am thinking, how to do it.
+	// To move such messages to other consumers set MinIdleTime option.
 	Consumer string
 
+	// Consumer group. Default "qu_<name>_group".
+	//
+	// Every group of queue gets all messages of queue, so several services can
+	// consume same queue with different groups. Set AckMode to
+	// AckAndDeleteAcked in consumers of all groups in such case.
+	Group string
+
+	// Position in streams, from which group is created, if it doesn't exist:
+	// "$" - only new messages, "0" - all messages in streams, or explicit
+	// stream ID. Default "$".
+	//
+	// Group is checked at creation of consumer and is created again, if it is
+	// deleted while consumer reads it.
+	GroupStartID string
+
+	// Mode of ACK of messages. Default AckAndDelete.
+	//
+	// Must have identical value in all consumers of group.
+	AckMode AckMode
+
 	// Shard queue along different Redis Cluster nodes. Default 10.
 	//
 	// Ami queues spreads along cluster by default Redis Cluster ability - shards.
@@ -187,6 +455,52 @@ type ConsumerOptions struct {
 	// If you set this value lower then 0 - blocking will not be used.
 	Block time.Duration
 
+	// Minimal idle time of message, read by any consumer and not ACKed, to
+	// reclaim it by this consumer. Default 0 - reclaiming is disabled.
+	//
+	// If set, Ami periodically checks pending messages of all shards with
+	// XPENDING and takes messages, that idle longer then this value, with XCLAIM.
+	// Reclaimed messages are delivered to the same channel, that is returned by
+	// Start(). Own messages of consumer are reclaimed too, so messages, that
+	// stay pending after error of handler in Run, are redelivered.
+	// Set it to value bigger then maximum time of message processing, including
+	// time of waiting in consumer channel, otherwise slow processed messages
+	// will be processed twice.
+	MinIdleTime time.Duration
+
+	// Maximum amount of deliveries of one message. Default 0 - unlimited.
+	//
+	// Redis counts deliveries of every pending message. If message, read from
+	// backlog or reclaimed from other consumer, got more deliveries then this
+	// value - it is moved to dead-letter stream "qu{N}_<name>_dlq" of same
+	// shard and is not delivered to consumer channel.
+	// Dead-letter messages can be listed, inspected and requeued with
+	// Consumer.DeadMessages, Consumer.DeadMessage and Consumer.Requeue.
+	MaxDeliveries int64
+
+	// Period of moving messages, delayed by Nack or sent by Producer.SendAt
+	// and Producer.SendAfter, to queue streams.
+	// Default time.Second.
+	//
+	// Delayed messages are stored in sorted set "qu{N}_<name>_delayed" of
+	// same shard and are moved by all started consumers of queue.
+	DelayPeriod time.Duration
+
+	// Maximum period of moving of delayed messages, if there are no delayed
+	// messages or next message is due later. Default time.Second * 30.
+	//
+	// Check of sorted set is done with Lua script, so it is not done every
+	// DelayPeriod for queues without delayed messages. Nack with delay of
+	// this consumer starts check immediately, but messages, sent by
+	// Producer.SendAt and Producer.SendAfter or delayed by other consumers,
+	// may be moved up to DelayIdlePeriod later.
+	DelayIdlePeriod time.Duration
+
+	// Period of reclaiming check. Default time.Second * 10.
+	//
+	// Used only if MinIdleTime is set.
+	ReclaimPeriod time.Duration
+
 	// Limits maximum amount of ACK messages queue. Default 10000000.
 	//
 	// Bigger value got better ACK performance and bigger memory usage.
@@ -208,6 +522,135 @@ type ConsumerOptions struct {
 	// If you set optional ErrorNotifier, you will receiving errors notifications
 	// in interface function
 	ErrorNotifier ErrorNotifier
+
+	// If you set optional MetricsNotifier, you will receiving metrics of
+	// consumer in interface functions
+	MetricsNotifier MetricsNotifier
+
+	// If you set optional Tracer, every got message is traced from delivery
+	// to Ack or Nack. Context of trace is available with Message.Context().
+	Tracer Tracer
+
+	// Policy of retries of reading from Redis and sending ACKs to Redis.
+	// Default is infinite retries with full jitter backoff with 500ms base
+	// delay.
+	//
+	// If retries of ACK are exhausted, batch of ACKed messages is passed to
+	// FailNotifier, if it is set, and is dropped. Such messages stay pending
+	// and will be processed again.
+	// If retries of reading are exhausted, error is sent to ErrorNotifier and
+	// reading is started again.
+	RetryPolicy RetryPolicy
+
+	// If you set optional FailNotifier, you will receiving messages, ACKs of
+	// which are failed to send to Redis, in interface function.
+	FailNotifier FailNotifier
+
+	// Maximum amount of ACK batches, that are sending to Redis at same time.
+	// Default 0 - unlimited.
+	//
+	// If limit is reached, collecting of next batch waits for finish of one of
+	// sending batches, and Ack locks, when ACK buffer is full.
+	MaxInFlightPipelines int
+}
+
+// AckMode - mode of ACK of messages by consumer.
+type AckMode int
+
+const (
+	// AckAndDelete - message is deleted from stream, when it is ACKed, even if
+	// other groups of queue didn't get it. Suitable for queues with one group.
+	AckAndDelete AckMode = iota
+
+	// AckAndDeleteAcked - message is deleted from stream, when it is ACKed by
+	// all groups of stream, so every group gets all messages of queue.
+	//
+	// Message is deleted, if it is delivered to every group and is not pending
+	// in it. Group, that is created or deleted later, is not waited for.
+	// Nacked messages are returned to queue only for group of consumer, that
+	// did Nack. Messages, requeued from dead-letter stream, are got only by
+	// group, from which they were moved.
+	// ACK is more expensive in this mode: it is done by Lua script with
+	// XPENDING for every message and group, that blocks Redis while it runs,
+	// so script is called for every 100 messages of ACK batch.
+	AckAndDeleteAcked
+
+	// AckOnly - message is only ACKed and stays in stream, so stream can be
+	// read again for replay or audit.
+	//
+	// Set MaxLen or Retention of producer to delete old messages from stream.
+	// Nacked messages are returned to queue same as in AckAndDeleteAcked mode
+	// and original messages stay in stream too.
+	AckOnly
+)
+
+// Inspector client for Ami.
+//
+// Inspector reports state of queue: lengths of streams, pending messages,
+// consumers and lags. Inspector doesn't create queue streams and groups, until
+// CreateGroup is called.
+type Inspector struct {
+	cl  *client
+	opt InspectorOptions
+}
+
+// InspectorOptions - options for inspector client for Ami.
+type InspectorOptions struct {
+	// Queue name
+	Name string
+
+	// Shard queue along different Redis Cluster nodes. Default 10.
+	//
+	// Must have identical value with producers and consumers of this queue.
+	ShardsCount int8
+
+	// Consumer group, used by Peek, Tail, RequeuePending and DeleteConsumer.
+	// Default "qu_<name>_group".
+	Group string
+
+	// Mode of ACK of messages, requeued by RequeuePending. Default
+	// AckAndDelete.
+	//
+	// Must have identical value with consumers of Group.
+	AckMode AckMode
+}
+
+// QueueStats - state of queue, aggregated by all shards.
+type QueueStats struct {
+	Name    string // Queue name
+	Length  int64  // Amount of messages in all shards
+	Pending int64  // Amount of read, but not ACKed messages in all groups
+	Lag     int64  // Amount of not read messages in all groups, -1 if unknown
+
+	Shards []ShardStats
+}
+
+// ShardStats - state of one shard of queue.
+type ShardStats struct {
+	Stream string // Redis stream name
+	Length int64  // Amount of messages in stream
+
+	Groups []GroupStats
+}
+
+// GroupStats - state of consumer group in one shard of queue.
+type GroupStats struct {
+	Name            string // Redis stream group name
+	Pending         int64  // Amount of read, but not ACKed messages
+	LastDeliveredID string // ID of last message, read by group
+
+	// Amount of not read messages. Reported by Redis 7.0 or later, -1 if
+	// unknown.
+	Lag int64
+
+	Consumers []ConsumerStats
+}
+
+// ConsumerStats - state of consumer in consumer group.
+type ConsumerStats struct {
+	Name    string        // Consumer name
+	Pending int64         // Amount of read, but not ACKed messages
+	Idle    time.Duration // Time since last read of consumer
 }
 
 // ErrorNotifier is the interface for receive error notifications
@@ -216,11 +659,144 @@ type ErrorNotifier interface {
 	AmiError(error)
 }
 
+// TrimNotifier is the interface for receive notifications about trimmed
+// messages
+type TrimNotifier interface {
+	// Function is called for every trim of stream, that deleted messages
+	AmiTrimmed(stream string, count int64)
+}
+
+// Period of reporting of length of send and ACK buffers to MetricsNotifier
+const bufferMetricPeriod = time.Second
+
+// MetricsNotifier is the interface for receive metrics of producer and
+// consumer.
+//
+// Functions are called synchronously from goroutines of Ami, so they must be
+// fast and safe for concurrent use.
+// Ready-made Prometheus collector is in package
+// github.com/kak-tus/ami/prometheus.
+//
+// Operations are:
+//
+// - "send" - XADD of batch of messages by producer;
+//
+// - "ack" - XACK and XDEL of batch of messages by consumer;
+//
+// - "read" - XREADGROUP by consumer.
+//
+// Buffers are:
+//
+// - "pending" - send buffer of producer (PendingBufferSize);
+//
+// - "ack" - ACK buffer of consumer (PendingBufferSize);
+//
+// - "consume" - consumer channel (PrefetchCount).
+type MetricsNotifier interface {
+	// Function is called with current length and capacity of buffer: every
+	// second for send and ACK buffers and on every read for consumer channel
+	AmiBuffer(queue string, buffer string, length int, capacity int)
+
+	// Function is called for every message, pushed to consumer channel
+	AmiConsumed(queue string, shard int, count int)
+
+	// Function is called with delta 1, when pipeline of operation is started,
+	// and with delta -1, when it is finished
+	AmiInFlight(queue string, op string, delta int)
+
+	// Function is called with time of waiting of free slot for pipeline of
+	// operation, if MaxInFlightPipelines is set
+	AmiInFlightWait(queue string, op string, duration time.Duration)
+
+	// Function is called, when pipeline of operation with count messages is
+	// finished. err is not nil, if pipeline is failed and messages are not
+	// processed
+	AmiPipeline(queue string, shard int, op string, count int, duration time.Duration, err error)
+
+	// Function is called for every failed attempt of operation, that will be
+	// retried
+	AmiRetry(queue string, shard int, op string, err error)
+}
+
+// RetryPolicy - policy of retries of Redis operations.
+//
+// Every failed attempt is retried after random delay from 0 to BaseDelay,
+// that is doubled after every attempt up to MaxDelay, until attempts or time
+// are exhausted, error is permanent or producer or consumer is closed.
+type RetryPolicy struct {
+	// Maximum amount of attempts, including first. Default 0 - unlimited.
+	MaxAttempts int
+
+	// Maximum time of retries since first failed attempt. Default 0 -
+	// unlimited.
+	MaxElapsedTime time.Duration
+
+	// Base delay of backoff. Default 500ms.
+	BaseDelay time.Duration
+
+	// Maximum delay between attempts. Default 0 - unlimited.
+	MaxDelay time.Duration
+
+	// Classifier of errors. If it returns true - error is permanent and
+	// operation is not retried. Default nil - all errors are temporary.
+	IsPermanent func(err error) bool
+}
+
+// FailNotifier is the interface for receive messages, that are failed to be
+// sent to Redis after all retries
+type FailNotifier interface {
+	// Function is called for every failed batch.
+	// op is "send" for messages of producer, Body, Headers and Stream of
+	// messages are set.
+	// op is "overflow" for messages of producer, dropped by OverflowPolicy,
+	// Body and Headers of messages are set.
+	// op is "ack" for ACKs of consumer, ID, Stream and Group of messages are
+	// set.
+	AmiFailed(op string, msgs []Message, err error)
+}
+
+// Tracer is the interface for tracing of messages from producer to consumer.
+//
+// Ready-made OpenTelemetry tracer is in module github.com/kak-tus/ami/otel.
+type Tracer interface {
+	// Function is called for every message, before it is pushed to send
+	// buffer of producer. Context is context of Send call or
+	// context.Background(), if Send call is without context.
+	// Function may add propagation data to headers, they are sent with
+	// message. Returned function, if not nil, is called, when message is sent
+	// to Redis or sending is failed.
+	AmiSend(ctx context.Context, queue string, headers map[string]string) func(id string, err error)
+
+	// Function is called for every message, before it is pushed to consumer
+	// channel. Returned context is available with Message.Context().
+	AmiReceive(m Message) context.Context
+
+	// Function is called on Ack of message
+	AmiAck(m Message)
+
+	// Function is called on Nack of message with result of Nack, on error or
+	// panic of handler in Run with this error and for messages, that are not
+	// pushed to consumer channel, because consumer is stopped, with context
+	// error
+	AmiNack(m Message, err error)
+}
+
 var defaultProducerOptions = ProducerOptions{
 	ShardsCount:       10,
 	PendingBufferSize: 10000000,
 	PipeBufferSize:    50000,
 	PipePeriod:        time.Microsecond * 1000,
+	TrimPeriod:        time.Minute,
+	RetryPolicy:       defaultRetryPolicy,
+	SpoolSyncPeriod:   time.Second,
+	SpoolReplayPeriod: time.Second * 10,
+	SpoolSegmentSize:  64 * 1024 * 1024,
+	OverflowTimeout:   time.Second,
+	GroupStartID:      "$",
+}
+
+var defaultInspectorOptions = InspectorOptions{
+	ShardsCount: 10,
 }
 
 var defaultConsumerOptions = ConsumerOptions{
@@ -229,4 +805,13 @@ var defaultConsumerOptions = ConsumerOptions{
 	PendingBufferSize: 10000000,
 	PipeBufferSize:    50000,
 	PipePeriod:        time.Microsecond * 1000,
+	ReclaimPeriod:     time.Second * 10,
+	DelayPeriod:       time.Second,
+	DelayIdlePeriod:   time.Second * 30,
+	RetryPolicy:       defaultRetryPolicy,
+	GroupStartID:      "$",
+}
+
+var defaultRetryPolicy = RetryPolicy{
+	BaseDelay: 500 * time.Millisecond,
 }